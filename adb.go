@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ADB transport protocol, see
+// https://android.googlesource.com/platform/packages/modules/adb/+/HEAD/protocol.txt
+const (
+	adbCNXN = 0x4e584e43
+	adbAUTH = 0x48545541
+	adbSTLS = 0x534c5453
+
+	adbVersion    = 0x01000001
+	adbMaxPayload = 256 * 1024
+
+	adbAuthToken     = 1
+	adbAuthSignature = 2
+)
+
+var (
+	errNotADB = errors.New("not an ADB device")
+)
+
+// adbDevice is an ADB device found on the network.
+type adbDevice struct {
+	Address string
+	// State is "device" if the device accepted our key, "unauthorized" if
+	// it asks for authorization or "tls" if it only accepts TLS connections
+	// (wireless debugging on Android 11+). "pairing" is the pairing service
+	// of wireless debugging.
+	State   string
+	Product string
+	Model   string
+	Device  string
+	// Name is the mDNS instance name if the device was found by mDNS.
+	Name string
+}
+
+func (d *adbDevice) String() string {
+	s := d.Address
+	if d.Model != "" {
+		s += " " + d.Model
+		if d.Product != "" {
+			s += " (" + d.Product + ")"
+		}
+	} else if d.Name != "" {
+		s += " " + d.Name
+	}
+	switch d.State {
+	case "unauthorized":
+		s += " [needs authorization]"
+	case "tls":
+		s += " [wireless debugging]"
+	case "pairing":
+		s += " [pairing]"
+	}
+	return s
+}
+
+// addressOf returns the address in a text shown in the address box, like
+// "192.168.1.5:5555 Pixel 4 (flame)" or "[fe80::5%12]:5555 Pixel 4 (flame)".
+func addressOf(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ""
+	}
+	return normalizeAddress(fields[0])
+}
+
+// normalizeAddress adds the default port to IP addresses and brackets to
+// IPv6 addresses the way adb names devices, so that "fe80::5%eth0" becomes
+// "[fe80::5%12]:5555". Serials and host names are returned as they are.
+func normalizeAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), strconv.Itoa(defaultADBPort)
+	}
+	ip, zone := splitZone(host)
+	if net.ParseIP(ip) == nil {
+		return addr
+	}
+	if zone != "" {
+		ip += "%" + numericZone(zone)
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+type adbMessage struct {
+	command uint32
+	arg0    uint32
+	arg1    uint32
+	data    []byte
+}
+
+func writeADBMessage(w io.Writer, m adbMessage) error {
+	header := make([]byte, 24)
+	var sum uint32
+	for _, b := range m.data {
+		sum += uint32(b)
+	}
+	binary.LittleEndian.PutUint32(header[0:], m.command)
+	binary.LittleEndian.PutUint32(header[4:], m.arg0)
+	binary.LittleEndian.PutUint32(header[8:], m.arg1)
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(m.data)))
+	binary.LittleEndian.PutUint32(header[16:], sum)
+	binary.LittleEndian.PutUint32(header[20:], m.command^0xffffffff)
+	_, err := w.Write(append(header, m.data...))
+	return err
+}
+
+func readADBMessage(r io.Reader) (m adbMessage, err error) {
+	header := make([]byte, 24)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	m.command = binary.LittleEndian.Uint32(header[0:])
+	m.arg0 = binary.LittleEndian.Uint32(header[4:])
+	m.arg1 = binary.LittleEndian.Uint32(header[8:])
+	length := binary.LittleEndian.Uint32(header[12:])
+	if binary.LittleEndian.Uint32(header[20:]) != m.command^0xffffffff || length > adbMaxPayload {
+		err = errNotADB
+		return
+	}
+	m.data = make([]byte, length)
+	_, err = io.ReadFull(r, m.data)
+	return
+}
+
+// probeADB connects to addr and performs the CNXN handshake to tell ADB
+// devices from other services listening on the port. key is the key of
+// loadADBKey, if there is one, loaded once for all the probes of a scan.
+func probeADB(ctx context.Context, addr string, key *rsa.PrivateKey) (*adbDevice, error) {
+	dialer := &net.Dialer{Timeout: 500 * time.Millisecond}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	err = writeADBMessage(conn, adbMessage{
+		command: adbCNXN,
+		arg0:    adbVersion,
+		arg1:    adbMaxPayload,
+		data:    []byte("host::\x00"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	d := &adbDevice{Address: addr}
+	signed := false
+	for {
+		m, err := readADBMessage(conn)
+		if err != nil {
+			if d.State != "" {
+				return d, nil
+			}
+			return nil, errNotADB
+		}
+		switch m.command {
+		case adbCNXN:
+			d.State = "device"
+			parseADBBanner(d, string(m.data))
+			return d, nil
+		case adbSTLS:
+			d.State = "tls"
+			return d, nil
+		case adbAUTH:
+			d.State = "unauthorized"
+			if m.arg0 != adbAuthToken || key == nil || signed {
+				return d, nil
+			}
+			// the token is signed as if it were a SHA-1 digest
+			sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA1, m.data)
+			if err != nil {
+				return d, nil
+			}
+			signed = true
+			if err := writeADBMessage(conn, adbMessage{command: adbAUTH, arg0: adbAuthSignature, data: sig}); err != nil {
+				return d, nil
+			}
+		default:
+			return nil, errNotADB
+		}
+	}
+}
+
+// parseADBBanner parses the identity of a device from its banner, like
+// "device::ro.product.name=flame;ro.product.model=Pixel 4;ro.product.device=flame;features=...".
+func parseADBBanner(d *adbDevice, banner string) {
+	banner = strings.TrimRight(banner, "\x00")
+	if i := strings.Index(banner, "::"); i > -1 {
+		banner = banner[i+2:]
+	}
+	for _, prop := range strings.Split(banner, ";") {
+		kv := strings.SplitN(prop, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ro.product.name":
+			d.Product = kv[1]
+		case "ro.product.model":
+			d.Model = kv[1]
+		case "ro.product.device":
+			d.Device = kv[1]
+		}
+	}
+}
+
+// loadADBKey loads the private key the adb server uses to authenticate
+// with devices, so that devices that have authorized this computer can be
+// identified.
+func loadADBKey() *rsa.PrivateKey {
+	dir := os.Getenv("ANDROID_SDK_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = home
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, ".android", "adbkey"))
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key
+	}
+	return nil
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The HTTP API of the daemon. Requests and responses are JSON, operations
+// on devices are queued as jobs whose progress is at /api/jobs/<id>.
+//
+//	GET  /api/devices           connected devices and those of the inventory
+//	POST /api/scan              scan the networks, like the Scan link
+//	GET  /api/images            images of the store to flash
+//	POST /api/images            {"source": url or path}, download an image
+//	POST /api/images/<id>/use   make an image the current one
+//	POST /api/view              {"device": ...}, mirror the screen here
+//	GET  /api/packages          third-party packages, ?device=..., with
+//	                            &details=1&filter=third-party|system|all
+//	POST /api/packages/<action> {"device": ..., "package": ...}, launch,
+//	                            force-stop, clear-data, clear-cache, disable,
+//	                            enable, or grant or revoke a "permission"
+//	POST /api/install           upload APKs (multipart "apk") to "device"
+//	POST /api/uninstall         {"device": ..., "package": ..., "keep_data": false}
+//	POST /api/flash             {"device": ..., "image": id}, current if no id
+//	GET  /api/jobs              recent jobs
+//	GET  /api/jobs/<id>         a job and the progress of its steps
+//	POST /api/jobs/<id>/cancel  stop a job
+//	POST /api/stop              stop every job
+//	GET  /api/events            server-sent events, ?level=info&device=...
+//	GET  /api/audit             the audit log, ?format=csv&from=...&to=...
+//
+// The device may be an address, a serial or a set like tag:store-12, the
+// only connected device is used if it is omitted. The audit log names the
+// operator in the X-Operator header as the one who ran the jobs, or the
+// user running the daemon if there is none.
+
+// maximum size of the APKs uploaded at once
+const maxUpload = 4 << 30
+
+type apiDevice struct {
+	Serial   string   `json:"serial"`
+	State    string   `json:"state"`
+	Model    string   `json:"model,omitempty"`
+	Product  string   `json:"product,omitempty"`
+	Nickname string   `json:"nickname,omitempty"`
+	Site     string   `json:"site,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+type apiScanResult struct {
+	Address string `json:"address"`
+	State   string `json:"state"`
+	Model   string `json:"model,omitempty"`
+	Product string `json:"product,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+type apiImage struct {
+	ID       string    `json:"id"`
+	Source   string    `json:"source"`
+	Added    time.Time `json:"added"`
+	LastUsed time.Time `json:"last_used"`
+	Current  bool      `json:"current"`
+}
+
+type apiJob struct {
+	ID        string       `json:"id"`
+	Operation string       `json:"operation"`
+	Device    string       `json:"device"`
+	State     string       `json:"state"`
+	Error     string       `json:"error,omitempty"`
+	Steps     []stepStatus `json:"steps"`
+}
+
+func newAPIJob(j *job) apiJob {
+	state, err := j.state()
+	info := apiJob{
+		ID:        j.ID,
+		Operation: j.Name,
+		Device:    j.Device,
+		State:     state,
+		Steps:     []stepStatus{},
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+	for _, s := range j.progress() {
+		if s.Name != "" {
+			info.Steps = append(info.Steps, s)
+		}
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// only allows a method, and answers the others with 405.
+func only(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, errors.New("use "+method))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/devices", only("GET", apiDevices))
+	mux.HandleFunc("/api/scan", only("POST", apiScan))
+	mux.HandleFunc("/api/images", apiImages)
+	mux.HandleFunc("/api/images/", only("POST", apiUseImage))
+	mux.HandleFunc("/api/view", only("POST", apiView))
+	mux.HandleFunc("/api/packages", only("GET", apiPackages))
+	mux.HandleFunc("/api/packages/", only("POST", apiPackageAction))
+	mux.HandleFunc("/api/install", only("POST", apiInstall))
+	mux.HandleFunc("/api/uninstall", only("POST", apiUninstall))
+	mux.HandleFunc("/api/flash", only("POST", apiFlash))
+	mux.HandleFunc("/api/jobs", only("GET", apiJobs))
+	mux.HandleFunc("/api/jobs/", apiJobByID)
+	mux.HandleFunc("/api/stop", only("POST", func(w http.ResponseWriter, r *http.Request) {
+		queue.cancelAll()
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}))
+	mux.HandleFunc("/api/events", only("GET", apiEvents))
+	mux.HandleFunc("/api/audit", only("GET", apiAudit))
+	return mux
+}
+
+func apiDevices(w http.ResponseWriter, r *http.Request) {
+	devices := []apiDevice{}
+	seen := map[string]bool{}
+	inv := loadInventory()
+	for _, d := range monitor.list() {
+		device := apiDevice{Serial: d.Serial, State: d.State, Model: d.Model, Product: d.Product}
+		if known := inv.find(d.Serial); known != nil {
+			device.Nickname, device.Site, device.Tags = known.Nickname, known.Site, known.Tags
+			seen[known.Serial] = true
+		}
+		seen[d.Serial] = true
+		devices = append(devices, device)
+	}
+	for _, d := range inv.Devices {
+		if seen[d.Serial] || seen[d.Target()] {
+			continue
+		}
+		devices = append(devices, apiDevice{
+			Serial:   d.Target(),
+			State:    "disconnected",
+			Model:    d.Model,
+			Nickname: d.Nickname,
+			Site:     d.Site,
+			Tags:     d.Tags,
+		})
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// apiScan scans the networks of the scan options, or the targets and ports
+// given.
+func apiScan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Targets []string `json:"targets"`
+		Ports   string   `json:"ports"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	c := loadConfig()
+	if len(req.Targets) > 0 {
+		c.ScanTargets = req.Targets
+	}
+	if req.Ports != "" {
+		if _, err := parsePorts(req.Ports); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.ScanPorts = req.Ports
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+	results := []apiScanResult{}
+	for _, d := range scanDevices(ctx, c, func(done, total int) {}) {
+		results = append(results, apiScanResult{
+			Address: d.Address,
+			State:   d.State,
+			Model:   d.Model,
+			Product: d.Product,
+			Name:    d.Name,
+		})
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func apiImages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		apiDownload(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET or POST"))
+		return
+	}
+	imageIndexMutex.Lock()
+	idx := loadImageIndex()
+	imageIndexMutex.Unlock()
+	images := []apiImage{}
+	for id, info := range idx.Images {
+		images = append(images, apiImage{
+			ID:       id,
+			Source:   info.Source,
+			Added:    info.Added,
+			LastUsed: info.LastUsed,
+			Current:  id == idx.Current,
+		})
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Added.After(images[j].Added)
+	})
+	writeJSON(w, http.StatusOK, images)
+}
+
+// apiDownload downloads or copies an image into the store as a job.
+func apiDownload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Source string `json:"source"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	req.Source = strings.TrimSpace(req.Source)
+	if req.Source == "" {
+		writeError(w, http.StatusBadRequest, errors.New("source is missing"))
+		return
+	}
+	j := downloadJob(req.Source)
+	queue.add(j)
+	writeJSON(w, http.StatusAccepted, []apiJob{newAPIJob(j)})
+}
+
+// apiUseImage serves /api/images/<id>/use.
+func apiUseImage(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/images/"), "/")
+	if !strings.HasSuffix(path, "/use") {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	id := strings.TrimSuffix(path, "/use")
+	imageIndexMutex.Lock()
+	idx := loadImageIndex()
+	imageIndexMutex.Unlock()
+	if idx.Images[id] == nil {
+		writeError(w, http.StatusNotFound, errors.New("no image "+id))
+		return
+	}
+	if err := useImage(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"current": id})
+}
+
+func apiView(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Device string `json:"device"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if isTargetSet(req.Device) {
+		writeError(w, http.StatusBadRequest, errors.New("select a single device instead of "+req.Device))
+		return
+	}
+	queueJobs(w, r, req.Device, viewJob, nil)
+}
+
+// apiPackages lists the packages once the jobs queued on the device before
+// are finished, their names or with details.
+func apiPackages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	device := q.Get("device")
+	if isTargetSet(device) {
+		writeError(w, http.StatusBadRequest, errors.New("select a single device instead of "+device))
+		return
+	}
+	if err := checkDevice(device); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var result interface{}
+	var j *job
+	if q.Get("details") == "" {
+		packages := []string{}
+		j = packagesJob(addressOf(device), func(pkgs []string) {
+			packages = append(packages, pkgs...)
+		})
+		result = &packages
+	} else {
+		filter := q.Get("filter")
+		if filter == "" {
+			filter = "third-party"
+		}
+		packages := []*packageInfo{}
+		var err error
+		j, err = packageListJob(addressOf(device), filter, func(pkgs []*packageInfo) {
+			packages = append(packages, pkgs...)
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		result = &packages
+	}
+	select {
+	case err := <-queue.add(j):
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+	case <-r.Context().Done():
+		queue.cancel(j)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiPackageAction serves /api/packages/<action>.
+func apiPackageAction(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/packages/"), "/")
+	var req struct {
+		Device     string `json:"device"`
+		Package    string `json:"package"`
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := checkPackageAction(action, req.Package, req.Permission); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	queueJobs(w, r, req.Device, func(target string) *job {
+		return packageActionJob(target, action, req.Package, req.Permission)
+	}, nil)
+}
+
+// deviceAddress is the address of a network device, as normalizeAddress
+// returns it.
+var deviceAddress = regexp.MustCompile(`^(\[[0-9A-Fa-f:.]+(%[0-9]+)?\]|[A-Za-z0-9.-]+):[0-9]+$`)
+
+// checkDevice returns why the device of a request is not one the daemon
+// may run adb on: a connected device, one of the inventory, an address or
+// a set. The serial ends up on command lines, so nothing else will do.
+func checkDevice(text string) error {
+	if strings.TrimSpace(text) == "" || isTargetSet(text) {
+		return nil
+	}
+	addr := addressOf(text)
+	if deviceAddress.MatchString(addr) {
+		return nil
+	}
+	if _, ok := monitor.get(addr); ok {
+		return nil
+	}
+	if loadInventory().find(addr) != nil {
+		return nil
+	}
+	return errors.New("unknown device " + text)
+}
+
+// queueJobs queues a job on every device of target and answers with them,
+// or with the error and false if target is not valid.
+func queueJobs(w http.ResponseWriter, r *http.Request, target string, newJob func(target string) *job, done func()) bool {
+	targets, _, err := resolveTargets(target)
+	if err == nil {
+		err = checkDevice(target)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		if done != nil {
+			done()
+		}
+		return false
+	}
+	// queued before answering, so that the jobs can be looked up or
+	// cancelled as soon as the client has their ids
+	var results []<-chan error
+	var infos []apiJob
+	for _, t := range targets {
+		j := newJob(t)
+		if name := requestOperator(r); name != "" {
+			j.Operator = name
+		}
+		results = append(results, queue.add(j))
+		infos = append(infos, newAPIJob(j))
+	}
+	go func() {
+		for _, result := range results {
+			<-result
+		}
+		if done != nil {
+			done()
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, infos)
+	return true
+}
+
+// requestOperator returns the operator of the X-Operator header.
+func requestOperator(r *http.Request) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, r.Header.Get("X-Operator"))
+	name = strings.TrimSpace(name)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	return name
+}
+
+var uploadName = regexp.MustCompile(`[^\w.-]+`)
+
+// apiInstall installs the APKs uploaded as the apk parts of a multipart
+// form, which are removed once installed.
+func apiInstall(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	dir, err := ioutil.TempDir("", "adbinstall-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	remove := func() { os.RemoveAll(dir) }
+	device := ""
+	var apks []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			remove()
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch part.FormName() {
+		case "device":
+			b, _ := ioutil.ReadAll(io.LimitReader(part, 1024))
+			device = strings.TrimSpace(string(b))
+		case "apk":
+			path, err := saveUpload(dir, len(apks), part)
+			if err != nil {
+				remove()
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			apks = append(apks, path)
+		}
+	}
+	if len(apks) == 0 {
+		remove()
+		writeError(w, http.StatusBadRequest, errors.New("no apk uploaded"))
+		return
+	}
+	queueJobs(w, r, device, func(target string) *job {
+		return installJob(target, apks)
+	}, remove)
+}
+
+// saveUpload saves an uploaded APK as the nth file in dir, keeping its name
+// for the log.
+func saveUpload(dir string, n int, part *multipart.Part) (string, error) {
+	name := uploadName.ReplaceAllString(filepath.Base(part.FileName()), "_")
+	if !strings.HasSuffix(strings.ToLower(name), ".apk") {
+		name += ".apk"
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s", n+1, name))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, part); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+func apiUninstall(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Device   string `json:"device"`
+		Package  string `json:"package"`
+		KeepData bool   `json:"keep_data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := checkPackageName(req.Package); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	queueJobs(w, r, req.Device, func(target string) *job {
+		return uninstallJob(target, req.Package, req.KeepData)
+	}, nil)
+}
+
+func apiFlash(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Device string `json:"device"`
+		Image  string `json:"image"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	dir := currentImageDir()
+	if req.Image != "" {
+		imageIndexMutex.Lock()
+		idx := loadImageIndex()
+		imageIndexMutex.Unlock()
+		if idx.Images[req.Image] == nil {
+			writeError(w, http.StatusNotFound, errors.New("no image "+req.Image))
+			return
+		}
+		dir = imageFilesDir(imagePath(req.Image))
+	}
+	queued := queueJobs(w, r, req.Device, func(target string) *job {
+		return flashJob(target, dir)
+	}, nil)
+	// the image is only made the current one for a flash that is queued
+	if !queued {
+		return
+	}
+	if req.Image == "" {
+		markImageUsed()
+	} else {
+		useImage(req.Image)
+	}
+}
+
+func apiJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := []apiJob{}
+	for _, j := range queue.recent() {
+		jobs = append(jobs, newAPIJob(j))
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// apiJobByID serves /api/jobs/<id> and /api/jobs/<id>/cancel.
+func apiJobByID(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+	id, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		id, action = path[:i], path[i+1:]
+	}
+	j := queue.find(id)
+	if j == nil {
+		writeError(w, http.StatusNotFound, errors.New("no job "+id))
+		return
+	}
+	switch action {
+	case "":
+		only("GET", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, newAPIJob(j))
+		})(w, r)
+	case "cancel":
+		only("POST", func(w http.ResponseWriter, r *http.Request) {
+			queue.cancel(j)
+			writeJSON(w, http.StatusOK, newAPIJob(j))
+		})(w, r)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("no such action "+action))
+	}
+}
+
+// apiEvents streams the events at or above level, of device if given, as
+// server-sent events. The recent events are sent first if history is set.
+func apiEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	q := r.URL.Query()
+	level := q.Get("level")
+	if level == "" {
+		level = levelInfo
+	}
+	if _, ok := levelRanks[level]; !ok {
+		writeError(w, http.StatusBadRequest, errors.New("unknown level "+level))
+		return
+	}
+	device := q.Get("device")
+	match := func(e logEvent) bool {
+		return levelRanks[e.Level] >= levelRanks[level] && (device == "" || e.Device == device)
+	}
+	ch := make(chan logEvent, 256)
+	unsubscribe := events.subscribe(func(e logEvent) {
+		if !match(e) {
+			return
+		}
+		select {
+		case ch <- e:
+		default: // the client is too slow, drop it
+		}
+	})
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(e logEvent) {
+		b, _ := json.Marshal(e)
+		fmt.Fprintf(w, "data: %s\n\n", b)
+	}
+	if q.Get("history") != "" {
+		for _, e := range events.list() {
+			if match(e) {
+				send(e)
+			}
+		}
+	}
+	flusher.Flush()
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			send(e)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// apiAudit exports the audit log. Whether its chain of hashes is intact is
+// told by the X-Audit-Verified header, and where it is broken by
+// X-Audit-Error.
+func apiAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	from, err := parseAuditDate(q.Get("from"), false)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseAuditDate(q.Get("to"), true)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch format {
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("unknown format "+format+", use jsonl or csv"))
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="adbinstall-audit.`+format+`"`)
+	if _, err := readAudit(); err != nil {
+		w.Header().Set("X-Audit-Verified", "false")
+		w.Header().Set("X-Audit-Error", err.Error())
+	} else {
+		w.Header().Set("X-Audit-Verified", "true")
+	}
+	exportAudit(w, format, from, to)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Chunk types of the binary XML format AndroidManifest.xml is compiled to,
+// see frameworks/base/libs/androidfw/include/androidfw/ResourceTypes.h
+const (
+	axmlStringPool   = 0x0001
+	axmlXML          = 0x0003
+	axmlStartElement = 0x0102
+	axmlResourceMap  = 0x0180
+
+	axmlUTF8Flag = 1 << 8
+
+	axmlTypeString = 0x03
+	axmlTypeIntDec = 0x10
+	axmlTypeIntHex = 0x11
+
+	androidAttrVersionCode = 0x0101021b
+	androidAttrVersionName = 0x0101021c
+)
+
+var (
+	errInvalidManifest = errors.New("invalid AndroidManifest.xml")
+)
+
+type apkInfo struct {
+	Package     string
+	VersionCode string
+	VersionName string
+	SHA256      string
+}
+
+func (a *apkInfo) Version() string {
+	if a.VersionName == "" {
+		return a.VersionCode
+	}
+	return fmt.Sprintf("%s (%s)", a.VersionName, a.VersionCode)
+}
+
+// readAPKInfo returns the package name and version of an APK.
+func readAPKInfo(path string) (*apkInfo, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var manifest []byte
+	for _, f := range r.File {
+		if f.Name != "AndroidManifest.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s: no AndroidManifest.xml", path)
+	}
+	info, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	info.SHA256, err = fileSHA256(path)
+	return info, err
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseManifest reads the attributes of the <manifest> element.
+func parseManifest(b []byte) (*apkInfo, error) {
+	if len(b) < 8 || binary.LittleEndian.Uint16(b) != axmlXML {
+		return nil, errInvalidManifest
+	}
+	var pool []string
+	var resourceIDs []uint32
+	offset := int(binary.LittleEndian.Uint16(b[2:]))
+	for offset+8 <= len(b) {
+		chunkType := binary.LittleEndian.Uint16(b[offset:])
+		headerSize := int(binary.LittleEndian.Uint16(b[offset+2:]))
+		size := int(binary.LittleEndian.Uint32(b[offset+4:]))
+		if size < 8 || offset+size > len(b) {
+			return nil, errInvalidManifest
+		}
+		chunk := b[offset : offset+size]
+		switch chunkType {
+		case axmlStringPool:
+			var err error
+			if pool, err = parseStringPool(chunk); err != nil {
+				return nil, err
+			}
+		case axmlResourceMap:
+			for i := headerSize; i+4 <= len(chunk); i += 4 {
+				resourceIDs = append(resourceIDs, binary.LittleEndian.Uint32(chunk[i:]))
+			}
+		case axmlStartElement:
+			if headerSize+20 > len(chunk) {
+				return nil, errInvalidManifest
+			}
+			ext := chunk[headerSize:]
+			name := binary.LittleEndian.Uint32(ext[4:])
+			if int(name) >= len(pool) || pool[name] != "manifest" {
+				break
+			}
+			attrStart := int(binary.LittleEndian.Uint16(ext[8:]))
+			attrSize := int(binary.LittleEndian.Uint16(ext[10:]))
+			attrCount := int(binary.LittleEndian.Uint16(ext[12:]))
+			info := &apkInfo{}
+			for i := 0; i < attrCount; i++ {
+				a := attrStart + i*attrSize
+				if a+20 > len(ext) {
+					return nil, errInvalidManifest
+				}
+				attr := ext[a:]
+				nameIdx := binary.LittleEndian.Uint32(attr[4:])
+				var attrName string
+				if int(nameIdx) < len(pool) {
+					attrName = pool[nameIdx]
+				}
+				var resID uint32
+				if int(nameIdx) < len(resourceIDs) {
+					resID = resourceIDs[nameIdx]
+				}
+				raw := binary.LittleEndian.Uint32(attr[8:])
+				dataType := attr[15]
+				data := binary.LittleEndian.Uint32(attr[16:])
+				var value string
+				switch {
+				case dataType == axmlTypeString && int(data) < len(pool):
+					value = pool[data]
+				case raw != 0xffffffff && int(raw) < len(pool):
+					value = pool[raw]
+				case dataType == axmlTypeIntDec || dataType == axmlTypeIntHex:
+					value = strconv.FormatUint(uint64(data), 10)
+				default:
+					value = fmt.Sprintf("@0x%08x", data)
+				}
+				switch {
+				case attrName == "package":
+					info.Package = value
+				case resID == androidAttrVersionCode || attrName == "versionCode":
+					info.VersionCode = value
+				case resID == androidAttrVersionName || attrName == "versionName":
+					info.VersionName = value
+				}
+			}
+			if info.Package == "" {
+				return nil, errInvalidManifest
+			}
+			return info, nil
+		}
+		offset += size
+	}
+	return nil, errInvalidManifest
+}
+
+func parseStringPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, errInvalidManifest
+	}
+	count := int(binary.LittleEndian.Uint32(chunk[8:]))
+	flags := binary.LittleEndian.Uint32(chunk[16:])
+	stringsStart := int(binary.LittleEndian.Uint32(chunk[20:]))
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	if headerSize+count*4 > len(chunk) {
+		return nil, errInvalidManifest
+	}
+	pool := make([]string, count)
+	for i := range pool {
+		o := stringsStart + int(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if o >= len(chunk) {
+			return nil, errInvalidManifest
+		}
+		if flags&axmlUTF8Flag != 0 {
+			_, n := decodeLength8(chunk[o:])
+			o += n
+			length, n := decodeLength8(chunk[o:])
+			o += n
+			if o+length > len(chunk) {
+				return nil, errInvalidManifest
+			}
+			pool[i] = string(chunk[o : o+length])
+		} else {
+			length, n := decodeLength16(chunk[o:])
+			o += n
+			if o+length*2 > len(chunk) {
+				return nil, errInvalidManifest
+			}
+			u := make([]uint16, length)
+			for j := range u {
+				u[j] = binary.LittleEndian.Uint16(chunk[o+j*2:])
+			}
+			pool[i] = string(utf16.Decode(u))
+		}
+	}
+	return pool, nil
+}
+
+func decodeLength8(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	if b[0]&0x80 != 0 && len(b) > 1 {
+		return int(b[0]&0x7f)<<8 | int(b[1]), 2
+	}
+	return int(b[0]), 1
+}
+
+func decodeLength16(b []byte) (int, int) {
+	if len(b) < 2 {
+		return 0, 0
+	}
+	l := int(binary.LittleEndian.Uint16(b))
+	if l&0x8000 != 0 && len(b) >= 4 {
+		return (l&0x7fff)<<16 | int(binary.LittleEndian.Uint16(b[2:])), 4
+	}
+	return l, 2
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archiveFormat describes how to recognize an image archive by its magic
+// bytes at offset and how to extract it into a directory.
+type archiveFormat struct {
+	name    string
+	offset  int
+	magic   []byte
+	extract func(ctx context.Context, file, dest string) error
+}
+
+var archiveFormats = []archiveFormat{
+	{"zip", 0, []byte("PK\x03\x04"), unzipFile},
+	{"gzip", 0, []byte{0x1f, 0x8b}, untarFile(func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	})},
+	{"xz", 0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, untarFile(func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	})},
+	{"zstd", 0, []byte{0x28, 0xb5, 0x2f, 0xfd}, untarFile(func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	})},
+	{"tar", 257, []byte("ustar"), untarFile(nil)},
+}
+
+var errUnknownArchive = errors.New("unsupported archive format")
+
+func detectArchiveFormat(file string) (*archiveFormat, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+	for i := range archiveFormats {
+		format := &archiveFormats[i]
+		end := format.offset + len(format.magic)
+		if end <= len(header) && bytes.Equal(header[format.offset:end], format.magic) {
+			return format, nil
+		}
+	}
+	return nil, errUnknownArchive
+}
+
+func extractFile(ctx context.Context, file, dest string) error {
+	format, err := detectArchiveFormat(file)
+	if err != nil {
+		return err
+	}
+	return format.extract(ctx, file, dest)
+}
+
+// extractPath returns where an archive entry should be written, refusing
+// names that would end up outside of dest.
+func extractPath(dest, name string) (string, error) {
+	path := filepath.Join(dest, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dest, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("illegal file path in archive: %s", name)
+	}
+	return path, nil
+}
+
+// untarFile returns an extractor for tar archives that are optionally
+// compressed by decompress. Since the uncompressed size of a compressed tar
+// is unknown until it has been read completely, progress is reported by the
+// amount of the archive file consumed, and the free space is checked for
+// every file before it is written.
+func untarFile(decompress func(io.Reader) (io.ReadCloser, error)) func(context.Context, string, string) error {
+	return func(ctx context.Context, file, dest string) error {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		total := fi.Size()
+		if decompress == nil {
+			// the size of a plain tar is close to the sum of its files
+			if err := checkFreeSpace(total); err != nil {
+				return err
+			}
+		}
+		if total == 0 {
+			total = 1
+		}
+		counter := &countingReader{r: f}
+		var r io.Reader = counter
+		if decompress != nil {
+			rc, err := decompress(r)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			r = rc
+		}
+		var name atomic.Value
+		name.Store("")
+		reportProgress := func() {
+			imageProgress(int(atomic.LoadInt64(&counter.n)*10000/total), "Extracting "+name.Load().(string))
+		}
+		defer reportProgress()
+		done := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := time.Tick(100 * time.Millisecond)
+			for {
+				reportProgress()
+				select {
+				case <-done:
+					return
+				case <-t:
+				}
+			}
+		}()
+		defer wg.Wait()
+		defer close(done)
+		tr := tar.NewReader(&contextReader{ctx: ctx, r: r})
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			path, err := extractPath(dest, hdr.Name)
+			if err != nil {
+				return err
+			}
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				if err := os.MkdirAll(path, 0755); err != nil {
+					return err
+				}
+			case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+				// the reader fills in the holes of sparse files
+				// a file extracted before is overwritten, as by a retry
+				need := hdr.Size
+				if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+					need -= fi.Size()
+				}
+				if err := checkFreeSpace(need); err != nil {
+					return err
+				}
+				name.Store(hdr.Name)
+				if err := untar(tr, path, hdr.FileInfo().Mode()); err != nil {
+					return err
+				}
+			case tar.TypeXGlobalHeader:
+			default:
+				// a link or device would leave the image incomplete
+				return fmt.Errorf("unsupported entry in archive: %s (type %q)", hdr.Name, hdr.Typeflag)
+			}
+		}
+	}
+}
+
+func untar(r io.Reader, path string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, r)
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// contextReader stops reading as soon as ctx is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records who flashed or installed what on which device, one
+// JSON object per line in audit.jsonl, which is only ever appended to. Every
+// entry has the hash of the entry before it, so that changing, removing or
+// reordering entries breaks the chain where it happened.
+
+// the previous hash of the first entry
+var auditGenesis = strings.Repeat("0", 64)
+
+var (
+	auditMutex = &sync.Mutex{}
+
+	// operator is who runs the jobs of the GUI and the command line, the
+	// user logged in to the system unless given.
+	operator = systemUser()
+
+	imageHashes      = map[string]string{}
+	imageHashesMutex = &sync.Mutex{}
+)
+
+// auditItem is what a step puts on or removes from a device: an image, an
+// APK or a package. The files are hashed when the entry is written. Steps
+// may share an item, like those flashing the partitions of an image, which
+// is only done if all of them are.
+type auditItem struct {
+	Kind    string `json:"kind"` // image, apk or package
+	Name    string `json:"name"` // image id or package name
+	Version string `json:"version,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	File    string `json:"file,omitempty"`
+	Result  string `json:"result,omitempty"` // done, failed or cancelled
+
+	files []string
+}
+
+type auditEntry struct {
+	Seq       int64       `json:"seq"`
+	Time      time.Time   `json:"time"`
+	Operator  string      `json:"operator"`
+	Station   string      `json:"station"`
+	Job       string      `json:"job"`
+	Operation string      `json:"operation"`
+	Device    string      `json:"device"`           // the address or serial adb used
+	Serial    string      `json:"serial,omitempty"` // the serial of the hardware, if known
+	Items     []auditItem `json:"items"`
+	Result    string      `json:"result"` // done, failed or cancelled
+	Error     string      `json:"error,omitempty"`
+	Prev      string      `json:"prev"`
+	Hash      string      `json:"hash"`
+}
+
+// digest returns the hash of the entry, of its JSON without the hash.
+func (e auditEntry) digest() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func auditFile() string {
+	return filepath.Join(dataDir, "audit.jsonl")
+}
+
+func systemUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	for _, name := range []string{"USERNAME", "USER"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return "unknown"
+}
+
+// imageAudit describes the image flashed from files. Its hash is that of
+// the lines "<sha256 of file>  <name of file>" of the files in the order
+// they are flashed, so it can be checked against a copy of the image.
+func imageAudit(dir string, files []string) *auditItem {
+	name := filepath.Base(dir)
+	if rel, err := filepath.Rel(imageDir, dir); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		name = strings.Split(filepath.ToSlash(rel), "/")[0]
+	}
+	return &auditItem{Kind: "image", Name: name, files: files}
+}
+
+func apkAudit(apk string) *auditItem {
+	return &auditItem{Kind: "apk", File: filepath.Base(apk), files: []string{apk}}
+}
+
+func packageAudit(pkg string) *auditItem {
+	return &auditItem{Kind: "package", Name: pkg}
+}
+
+// imageSHA256 hashes the files of an image, once for as long as they are
+// not changed.
+func imageSHA256(files []string) (string, error) {
+	var key strings.Builder
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&key, "%s %d %d\n", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	imageHashesMutex.Lock()
+	defer imageHashesMutex.Unlock()
+	if sum, ok := imageHashes[key.String()]; ok {
+		return sum, nil
+	}
+	h := sha256.New()
+	for _, f := range files {
+		sum, err := fileSHA256(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s  %s\n", sum, filepath.Base(f))
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	imageHashes[key.String()] = sum
+	return sum, nil
+}
+
+// hash fills in the version and hash of the files of the item.
+func (item auditItem) hash() auditItem {
+	switch item.Kind {
+	case "image":
+		item.SHA256, _ = imageSHA256(item.files)
+	case "apk":
+		if info, err := readAPKInfo(item.files[0]); err == nil {
+			item.Name, item.Version, item.SHA256 = info.Package, info.Version(), info.SHA256
+		} else {
+			item.SHA256, _ = fileSHA256(item.files[0])
+		}
+	}
+	return item
+}
+
+// auditJob records a finished job that changed what is on the device, with
+// the items of the steps that started and how each of them went.
+func auditJob(j *job) {
+	state, err := j.state()
+	status := j.progress()
+	var items []auditItem
+	seen := map[*auditItem]bool{}
+	for i, s := range j.Steps {
+		if s.Audit == nil || seen[s.Audit] || status[i].Started.IsZero() {
+			continue
+		}
+		seen[s.Audit] = true
+		item := s.Audit.hash()
+		item.Result = itemResult(j, s.Audit, status, state)
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return
+	}
+	e := auditEntry{
+		Time:      time.Now().UTC(),
+		Operator:  j.Operator,
+		Job:       j.ID,
+		Operation: j.Name,
+		Device:    j.serial(),
+		Items:     items,
+		Result:    state,
+	}
+	e.Station, _ = os.Hostname()
+	if d := loadInventory().find(defaultSerial(e.Device)); d != nil {
+		e.Serial = d.Serial
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := appendAudit(e); err != nil {
+		j.log(levelError, "", "audit log: "+err.Error(), nil)
+	}
+}
+
+// itemResult returns done if all steps of the item are, or else how the
+// first of them that is not ended, the state of the job if it was skipped.
+func itemResult(j *job, item *auditItem, status []stepStatus, state string) string {
+	for i, s := range j.Steps {
+		if s.Audit != item || status[i].State == "done" {
+			continue
+		}
+		if status[i].State == "failed" || status[i].State == "cancelled" {
+			return status[i].State
+		}
+		if state == "done" {
+			return "cancelled"
+		}
+		return state
+	}
+	return "done"
+}
+
+// appendAudit chains the entry to the last one in the file and appends it.
+// The GUI, the command line and the daemon may write at the same time, so
+// the file is locked from reading the last entry until the new one is in.
+func appendAudit(e auditEntry) error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(dataDir, "audit.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+	e.Seq, e.Prev = 1, auditGenesis
+	last, err := lastAuditEntry()
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		e.Seq, e.Prev = last.Seq+1, last.Hash
+	}
+	e.Hash = e.digest()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// lastAuditEntry reads the last line of the audit log, nil if it is empty.
+func lastAuditEntry() (*auditEntry, error) {
+	f, err := os.Open(auditFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const tail = 64 * 1024
+	if fi.Size() > tail {
+		if _, err := f.Seek(fi.Size()-tail, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimRight(b, "\n")
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	}
+	e := &auditEntry{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, errors.New("the last entry is damaged: " + err.Error())
+	}
+	return e, nil
+}
+
+// readAudit reads the audit log and checks the chain of hashes. The entries
+// are returned even if the chain is broken, with the error telling where.
+func readAudit() (entries []auditEntry, err error) {
+	f, err := os.Open(auditFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	prev := auditGenesis
+	var broken error
+	for line := 1; scanner.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			if broken == nil {
+				broken = fmt.Errorf("line %d: %v", line, err)
+			}
+			continue
+		}
+		if broken == nil {
+			switch {
+			case e.Prev != prev:
+				broken = fmt.Errorf("line %d: entry %d does not follow the one before it", line, e.Seq)
+			case e.Hash != e.digest():
+				broken = fmt.Errorf("line %d: entry %d has been changed", line, e.Seq)
+			}
+		}
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, err
+	}
+	if broken != nil {
+		return entries, errors.New("audit log is not intact: " + broken.Error())
+	}
+	return entries, nil
+}
+
+// exportAudit writes the entries between from and to, if they are not zero,
+// as JSON Lines that can be checked like the log itself or as CSV with a
+// row for every item. The chain is checked on the whole log, the entries
+// are written even if it is broken and the error is returned after.
+func exportAudit(w io.Writer, format string, from, to time.Time) error {
+	entries, verr := readAudit()
+	if verr != nil && entries == nil {
+		return verr
+	}
+	var selected []auditEntry
+	for _, e := range entries {
+		if (from.IsZero() || !e.Time.Before(from)) && (to.IsZero() || e.Time.Before(to)) {
+			selected = append(selected, e)
+		}
+	}
+	switch format {
+	case "jsonl", "":
+		enc := json.NewEncoder(w)
+		for _, e := range selected {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"seq", "time", "operator", "station", "operation", "device", "serial",
+			"kind", "name", "version", "sha256", "file", "result", "error", "hash"})
+		for _, e := range selected {
+			for _, item := range e.Items {
+				cw.Write([]string{strconv.FormatInt(e.Seq, 10), e.Time.Format(time.RFC3339),
+					e.Operator, e.Station, e.Operation, e.Device, e.Serial,
+					item.Kind, item.Name, item.Version, item.SHA256, item.File,
+					itemOrEntryResult(item, e), e.Error, e.Hash})
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown format " + format + ", use jsonl or csv")
+	}
+	return verr
+}
+
+// itemOrEntryResult returns the result of the item, or of the whole entry
+// for those written before items had their own.
+func itemOrEntryResult(item auditItem, e auditEntry) string {
+	if item.Result != "" {
+		return item.Result
+	}
+	return e.Result
+}
+
+// parseAuditDate parses the -from and -to dates of the export, a day like
+// 2024-05-01 in local time or a time like 2024-05-01T08:00:00Z. The day is
+// included by the export if it is the end.
+func parseAuditDate(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
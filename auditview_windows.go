@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+// login asks for the name of the operator for the audit log, and returns
+// false if the window is closed instead.
+func login() bool {
+	var dlg *walk.Dialog
+	var name *walk.LineEdit
+	var okButton, cancelButton *walk.PushButton
+	Dialog{
+		AssignTo:      &dlg,
+		Layout:        VBox{},
+		Title:         "Android Updater",
+		MinSize:       Size{320, 120},
+		FixedSize:     true,
+		DefaultButton: &okButton,
+		CancelButton:  &cancelButton,
+		Children: []Widget{
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					TextLabel{
+						Text:          "Operator:",
+						TextAlignment: AlignHNearVCenter,
+					},
+					LineEdit{
+						AssignTo: &name,
+						Text:     operator,
+					},
+				},
+			},
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					HSpacer{},
+					PushButton{
+						AssignTo: &okButton,
+						Text:     "OK",
+						OnClicked: func() {
+							if strings.TrimSpace(name.Text()) == "" {
+								return
+							}
+							dlg.Accept()
+						},
+					},
+					PushButton{
+						AssignTo:  &cancelButton,
+						Text:      "Cancel",
+						OnClicked: func() { dlg.Cancel() },
+					},
+				},
+			},
+		},
+	}.Create(nil)
+	updateDialog(dlg)
+	if dlg.Run() != walk.DlgCmdOK {
+		return false
+	}
+	operator = strings.TrimSpace(name.Text())
+	return true
+}
+
+// exportAuditLog saves the audit log as CSV or JSON Lines, and warns if
+// its chain of hashes is broken.
+func exportAuditLog() {
+	dlg := new(walk.FileDialog)
+	dlg.Filter = "CSV (*.csv)|*.csv|JSON Lines (*.jsonl)|*.jsonl"
+	dlg.Title = "Export Audit Log"
+	dlg.FilePath = "adbinstall-audit-" + time.Now().Format("20060102") + ".csv"
+	if ok, _ := dlg.ShowSave(md); !ok {
+		return
+	}
+	path, format := dlg.FilePath, "csv"
+	if dlg.FilterIndex == 2 || strings.HasSuffix(strings.ToLower(path), ".jsonl") {
+		format = "jsonl"
+	}
+	if !strings.HasSuffix(strings.ToLower(path), "."+format) {
+		path += "." + format
+	}
+	f, err := os.Create(path)
+	if err == nil {
+		err = exportAudit(f, format, time.Time{}, time.Time{})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+)
+
+const cliUsage = `Usage:
+  adbinstall install [-s device] app.apk...
+  adbinstall uninstall [-s device] [-k] package
+  adbinstall flash [-s device] [-image dir]
+  adbinstall run [-s device] [-var name=value]... recipe.yaml
+  adbinstall daemon [-listen address] [-token-file file]
+  adbinstall audit verify
+  adbinstall audit export [-format jsonl|csv] [-from date] [-to date] [-o file]
+
+The device is an address or serial, or a set of devices of the inventory
+like tag:store-12 or site:Shenzhen. The only connected device is used if
+it is omitted. Add -v to show debug messages, and -operator name to name
+someone else than the user logged in to the system in the audit log.
+`
+
+// runCLI runs an operation given on the command line with the same jobs as
+// the GUI, and returns the exit code.
+func runCLI(args []string) int {
+	attachConsole()
+	switch args[0] {
+	case "daemon":
+		return runDaemon(args[1:])
+	case "audit":
+		return runAudit(args[1:])
+	case "install", "uninstall", "flash", "run":
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	device := fs.String("s", "", "device")
+	image := fs.String("image", "", "image directory")
+	keepData := fs.Bool("k", false, "keep the data and cache when uninstalling")
+	verbose := fs.Bool("v", false, "show debug messages")
+	fs.StringVar(&operator, "operator", operator, "who runs the jobs, for the audit log")
+	vars := varsFlag{}
+	fs.Var(vars, "var", "recipe variable")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	// the bundled tools are found relative to the program
+	var files []string
+	for _, f := range fs.Args() {
+		if abs, err := filepath.Abs(f); err == nil && (args[0] == "run" || strings.HasSuffix(strings.ToLower(f), ".apk")) {
+			f = abs
+		}
+		files = append(files, f)
+	}
+	if *image != "" {
+		*image, _ = filepath.Abs(*image)
+	}
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+
+	events.subscribe(func(e logEvent) {
+		if *verbose || levelRanks[e.Level] >= levelRanks[levelInfo] {
+			fmt.Fprintln(os.Stdout, e)
+		}
+	})
+	startSessionLog()
+	defer session.close()
+
+	targets := []string{*device}
+	if *device != "" {
+		var err error
+		if targets, _, err = resolveTargets(*device); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	var jobs []*job
+	var r *recipe
+	for _, target := range targets {
+		switch args[0] {
+		case "install":
+			if len(files) == 0 {
+				fs.Usage()
+				return 2
+			}
+			jobs = append(jobs, installJob(target, files))
+		case "uninstall":
+			if len(files) != 1 {
+				fs.Usage()
+				return 2
+			}
+			jobs = append(jobs, uninstallJob(target, files[0], *keepData))
+		case "flash":
+			dir := *image
+			if dir == "" {
+				dir = currentImageDir()
+			}
+			jobs = append(jobs, flashJob(target, dir))
+		case "run":
+			if len(files) != 1 {
+				fs.Usage()
+				return 2
+			}
+			if r == nil {
+				var err error
+				if r, err = loadRecipe(files[0]); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 1
+				}
+			}
+			j, err := recipeJob(r, target, vars)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			jobs = append(jobs, j)
+		}
+	}
+
+	interrupted := make(chan bool)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(interrupted)
+		queue.cancelAll()
+	}()
+	var results []<-chan error
+	for _, j := range jobs {
+		results = append(results, queue.add(j))
+	}
+	code := 0
+	for _, r := range results {
+		if err := <-r; err != nil && code == 0 {
+			code = 1
+			var cmdErr *commandError
+			if errors.As(err, &cmdErr) {
+				code = cmdErr.ExitCode
+			}
+		}
+	}
+	select {
+	case <-interrupted:
+		return 130
+	default:
+		return code
+	}
+}
+
+// runAudit checks or exports the audit log, and returns the exit code,
+// which is 1 if the chain of hashes is broken.
+func runAudit(args []string) int {
+	if len(args) == 0 || (args[0] != "verify" && args[0] != "export") {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("audit "+args[0], flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	format := fs.String("format", "jsonl", "jsonl or csv")
+	fromText := fs.String("from", "", "first day")
+	toText := fs.String("to", "", "last day")
+	output := fs.String("o", "", "output file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if args[0] == "verify" {
+		entries, err := readAudit()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "%s: %d entries, intact\n", auditFile(), len(entries))
+		return 0
+	}
+	from, err := parseAuditDate(*fromText, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	to, err := parseAuditDate(*toText, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	w := os.Stdout
+	if *output != "" {
+		if w, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	err = exportAudit(w, *format, from, to)
+	if *output != "" {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// varsFlag collects the -var name=value flags.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	return ""
+}
+
+func (v varsFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return errors.New("not name=value")
+	}
+	v[s[:i]] = s[i+1:]
+	return nil
+}
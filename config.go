@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+var (
+	configMutex = &sync.Mutex{}
+)
+
+type config struct {
+	// ScanTargets are CIDR ranges, IP ranges, IP addresses or host names
+	// to scan, the networks of the local interfaces are scanned if empty.
+	ScanTargets []string `json:"scan_targets"`
+	// ScanPorts are the ports to probe on every host, like "5555",
+	// "5555, 5557" or "5555-5585".
+	ScanPorts       string `json:"scan_ports"`
+	ScanConcurrency int    `json:"scan_concurrency"`
+
+	// LogFileMB is the size at which a new log file is started, log files
+	// are removed after LogRetentionDays or when they take up more than
+	// LogRetentionMB in total.
+	LogFileMB        int `json:"log_file_mb"`
+	LogRetentionDays int `json:"log_retention_days"`
+	LogRetentionMB   int `json:"log_retention_mb"`
+
+	PairedDevices []*pairedDevice `json:"paired_devices"`
+
+	// AuditLogin asks for the name of the operator when the GUI starts,
+	// instead of naming the user logged in to Windows in the audit log.
+	AuditLogin bool `json:"audit_login"`
+}
+
+func configFile() string {
+	return filepath.Join(dataDir, "config.json")
+}
+
+func loadConfig() *config {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return readConfig()
+}
+
+func readConfig() *config {
+	c := &config{
+		ScanPorts:        strconv.Itoa(defaultADBPort),
+		ScanConcurrency:  64,
+		LogFileMB:        10,
+		LogRetentionDays: 30,
+		LogRetentionMB:   200,
+	}
+	if b, err := ioutil.ReadFile(configFile()); err == nil {
+		json.Unmarshal(b, c)
+	}
+	if c.ScanConcurrency <= 0 {
+		c.ScanConcurrency = 64
+	}
+	if c.LogFileMB <= 0 {
+		c.LogFileMB = 10
+	}
+	return c
+}
+
+func updateConfig(f func(c *config)) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	c := readConfig()
+	f(c)
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile(), b, 0644)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const daemonUsage = `Usage:
+  adbinstall daemon [-listen address] [-token-file file] [-v]
+
+Serves the web UI, the HTTP API and Prometheus metrics at /metrics at
+address, 127.0.0.1:8765 by default. Every API and metrics request must have
+the token in the token file as "Authorization: Bearer <token>" or as the
+token parameter. A random token is written to the file if it doesn't exist.
+`
+
+func defaultTokenFile() string {
+	return filepath.Join(dataDir, "api-token")
+}
+
+// readToken reads the API token from file, writing a new random one to it
+// if there is none.
+func readToken(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", errors.New(file + " is empty")
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// authorized checks the token of a request. EventSource can't set headers,
+// so the token may be a parameter as well.
+func authorized(r *http.Request, token string) bool {
+	given := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// runDaemon serves the API until it is interrupted, and returns the exit
+// code.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, daemonUsage) }
+	listen := fs.String("listen", "127.0.0.1:8765", "address to listen on")
+	tokenFile := fs.String("token-file", defaultTokenFile(), "file with the API token")
+	verbose := fs.Bool("v", false, "show debug messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+
+	events.subscribe(func(e logEvent) {
+		if *verbose || levelRanks[e.Level] >= levelRanks[levelInfo] {
+			fmt.Fprintln(os.Stdout, e)
+		}
+	})
+	startSessionLog()
+	defer session.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	monitor.subscribe(recordDeviceEvent)
+	go monitor.run(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", requireToken(token, apiHandler()))
+	mux.Handle("/metrics", requireToken(token, http.HandlerFunc(serveMetrics)))
+	mux.Handle("/", webHandler())
+	server := &http.Server{
+		Addr:    *listen,
+		Handler: mux,
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		queue.cancelAll()
+		sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer scancel()
+		server.Shutdown(sctx)
+	}()
+	fmt.Fprintf(os.Stdout, "Listening on %s, token in %s\nOpen http://%s/#token=%s\n", *listen, *tokenFile, *listen, token)
+	err = server.ListenAndServe()
+	killOwnADBServer()
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type insufficientSpaceError struct {
+	need int64
+	free int64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("Not enough disk space in %s: %s is needed but only %s is free. Please free up at least %s.",
+		imageDir, formatSize(e.need), formatSize(e.free), formatSize(e.need-e.free))
+}
+
+// checkFreeSpace returns an *insufficientSpaceError if the volume of
+// imageDir has less than need bytes available.
+func checkFreeSpace(need int64) error {
+	if need <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		return err
+	}
+	free, err := freeSpace(imageDir)
+	if err != nil {
+		// can't tell, let the write fail later if it has to
+		return nil
+	}
+	if free < need {
+		return &insufficientSpaceError{need: need, free: free}
+	}
+	return nil
+}
+
+// removeCachedImages deletes everything in imageDir except the current
+// image, images marked to keep and the files in keep, e.g. the partial
+// download that is about to be resumed.
+func removeCachedImages(keep ...string) error {
+outer:
+	for _, e := range listStore() {
+		if e.current || e.Keep != "" {
+			continue
+		}
+		for _, k := range keep {
+			if filepath.Clean(k) == e.path {
+				continue outer
+			}
+		}
+		if err := removeStoreEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
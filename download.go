@@ -6,192 +6,92 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/lxn/walk"
-	. "github.com/lxn/walk/declarative"
 )
 
-var (
-	progressBar    *walk.ProgressBar
-	urlComboBox    *walk.ComboBox
-	downloadButton *walk.PushButton
-	downloadStatus *walk.TextLabel
-	cancelDownload func()
-)
+// imageProgress is told how far extracting or copying an image has come, in
+// ten thousandths, and the file it is at.
+var imageProgress = func(value int, status string) {}
 
 type progress struct {
 	downloaded int64
 	total      int64
 }
 
-func showDownloader() {
-	os.MkdirAll(imageDir, 0755)
-	var downloader *walk.Dialog
-	absPath, _ := filepath.Abs(imageDir)
-	truncated := truncatePath(absPath, 30)
-	Dialog{
-		AssignTo:  &downloader,
-		Layout:    VBox{},
-		Title:     "Downloader",
-		MinSize:   Size{500, 120},
-		FixedSize: true,
-		Children: []Widget{
-			HSplitter{
-				Children: []Widget{
-					TextLabel{
-						Text:          "Location:",
-						StretchFactor: 1,
-						TextAlignment: AlignHNearVCenter,
-					},
-					Composite{
-						StretchFactor: 5,
-						Layout: VBox{
-							MarginsZero: true,
-							SpacingZero: true,
-						},
-						Children: []Widget{
-							LinkLabel{
-								MaxSize: Size{
-									Height: 12,
-								},
-								Alignment:   AlignHNearVCenter,
-								ToolTipText: absPath,
-								Text:        fmt.Sprintf(`<a href="%s">%s</a>`, absPath, truncated),
-								OnLinkActivated: func(link *walk.LinkLabelLink) {
-									exec.Command("explorer.exe", link.URL()).Run()
-								},
-							},
-							TextLabel{
-								StretchFactor: 1,
-							},
-						},
-					},
-				},
-			},
-			HSplitter{
-				Children: []Widget{
-					TextLabel{
-						Text:          "URL:",
-						StretchFactor: 1,
-						TextAlignment: AlignHNearVCenter,
-					},
-					Composite{
-						StretchFactor: 5,
-						Layout: VBox{
-							MarginsZero: true,
-						},
-						Children: []Widget{
-							ComboBox{
-								AssignTo:     &urlComboBox,
-								CurrentIndex: 0,
-								MaxSize: Size{
-									Width: 1,
-								},
-								Model: []string{
-									"https://zima.oss-cn-hongkong.aliyuncs.com/images/zima/SW_SD5300_V046_A03_fastboot.zip",
-								},
-								Editable: true,
-							},
-						},
-					},
-				},
-			},
-			HSplitter{
-				Children: []Widget{
-					TextLabel{
-						StretchFactor: 1,
-					},
-					HSplitter{
-						StretchFactor: 5,
-						Children: []Widget{
-							PushButton{
-								AssignTo: &downloadButton,
-								Text:     "DOWNLOAD",
-								OnClicked: func() {
-									download()
-								},
-							},
-							TextLabel{
-								AssignTo:      &downloadStatus,
-								TextAlignment: AlignHNearVCenter,
-								Text:          "Ready",
-								StretchFactor: 3,
-							},
-						},
-					},
-				},
-			},
-			HSplitter{
-				Children: []Widget{
-					TextLabel{
-						Text:          "Progress:",
-						StretchFactor: 1,
-						TextAlignment: AlignHNearVCenter,
-					},
-					Composite{
-						StretchFactor: 5,
-						Layout: VBox{
-							MarginsZero: true,
-						},
-						Children: []Widget{
-							ProgressBar{
-								AssignTo: &progressBar,
-								MaxValue: 10000,
-								MinValue: 0,
-							},
-						},
-					},
-				},
-			},
-		},
-	}.Create(md)
-	updateDialog(downloader)
-	downloader.Run()
-	if cancelDownload != nil {
-		cancelDownload()
+// fetchImage downloads or copies the image at src into the store. The
+// partial download is kept to resume it if it fails. progChan receives the
+// progress of a download if it is not nil.
+func fetchImage(ctx context.Context, src string, progChan chan progress) error {
+	id := imageID(src)
+	dest := imagePath(id)
+	if isLocalSource(src) {
+		return importLocal(ctx, src, dest)
+	}
+	file := partialPath(id)
+	if err := downloadFile(ctx, src, file, progChan); err != nil {
+		return err
+	}
+	if err := extractFile(ctx, file, dest); err != nil {
+		return err
 	}
-	go updateImageButtonText()
+	return os.Remove(file)
 }
 
-func download() {
-	if cancelDownload != nil {
-		cancelDownload()
-		cancelDownload = nil
-		downloadButton.SetText("DOWNLOAD")
-		return
-	}
-	url := urlComboBox.Text()
-	file := filepath.Join(imageDir, "tmp")
-	progChan := make(chan progress)
-	go func() {
-		for prog := range progChan {
-			progressBar.SetValue(int(prog.downloaded * 10000 / prog.total))
-			downloadStatus.SetText(fmt.Sprintf("Received %s out of %s", formatSize(prog.downloaded), formatSize(prog.total)))
-		}
-	}()
-	ctx, cancel := context.WithCancel(context.Background())
-	cancelDownload = cancel
-	downloadButton.SetText("STOP")
-	go func() {
-		err := downloadFile(ctx, url, file, progChan)
-		if err == nil {
-			err = unzipFile(ctx, file)
-		}
-		if err != nil && err != context.Canceled {
-			os.Remove(file)
-			walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
-		}
-		if err == nil {
-			os.Remove(file)
-			downloadStatus.SetText("Done")
-		}
-		cancelDownload = nil
-		downloadButton.SetText("DOWNLOAD")
-	}()
+// imageStore is the queue of the jobs on the image store, which download
+// one image at a time.
+const imageStore = "image store"
+
+// downloadJob downloads or copies the image at src into the store and makes
+// it the current image.
+func downloadJob(src string) *job {
+	id := imageID(src)
+	return newJob("download", imageStore, &step{
+		Name: "download " + id,
+		Run: func(ctx context.Context, j *job) error {
+			var progChan chan progress
+			var n int64
+			var elapsed time.Duration
+			received := make(chan bool)
+			if !isLocalSource(src) {
+				progChan = make(chan progress)
+				go func() {
+					defer close(received)
+					start := time.Now()
+					// the download may resume from what is there
+					first := int64(-1)
+					for p := range progChan {
+						p := p
+						if first < 0 {
+							first = p.downloaded
+						}
+						n = p.downloaded - first
+						j.update(func(s *stepStatus) {
+							s.Sent, s.Size = p.downloaded, p.total
+						})
+					}
+					elapsed = time.Since(start)
+				}()
+			}
+			err := fetchImage(ctx, src, progChan)
+			if progChan != nil {
+				<-received
+				downloadBytes.add(float64(n))
+				if err == nil && n > 0 && elapsed > 0 {
+					downloadSpeed.observe(float64(n) / elapsed.Seconds())
+				}
+			}
+			if err != nil {
+				if ctx.Err() == nil && !isLocalSource(src) {
+					os.Remove(partialPath(id))
+				}
+				return err
+			}
+			return addImage(id, src)
+		},
+	})
 }
 
 func downloadFile(ctx context.Context, url, file string, progChan chan progress) error {
@@ -212,6 +112,10 @@ func downloadFile(ctx context.Context, url, file string, progChan chan progress)
 		return err
 	}
 	client := &http.Client{}
+	// total is -1 when the server does not tell us the size, either
+	// because HEAD is not allowed or because Content-Length is missing
+	var total int64 = -1
+	acceptRanges := false
 	hctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 	req, err := http.NewRequestWithContext(hctx, "HEAD", url, nil)
@@ -219,10 +123,16 @@ func downloadFile(ctx context.Context, url, file string, progChan chan progress)
 		return err
 	}
 	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			total = resp.ContentLength
+			acceptRanges = strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes")
+		}
 	}
-	total := resp.ContentLength
 	reportProgress := func() {
 		if progChan == nil {
 			return
@@ -237,18 +147,16 @@ func downloadFile(ctx context.Context, url, file string, progChan chan progress)
 	defer reportProgress()
 	var start int64 = 0
 	fileSize := fi.Size()
-	if fileSize > 0 && strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes") {
+	if fileSize > 0 && total > 0 && acceptRanges {
 		if fileSize < total {
 			start = fileSize
 		} else if fileSize == total {
 			return nil
 		}
-	}
-	if start == 0 {
-		err := os.Truncate(file, 0)
-		if err != nil {
-			return err
-		}
+	} else if fileSize > 0 && total < 0 {
+		// size is unknown, try to resume anyway and let the status
+		// code of the response decide
+		start = fileSize
 	}
 	req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -262,6 +170,36 @@ func downloadFile(ctx context.Context, url, file string, progChan chan progress)
 		return err
 	}
 	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && start > 0:
+		if total < 0 {
+			total = contentRangeTotal(resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && start > 0:
+		// the partial file is already complete if its size equals the
+		// size reported by the server
+		if t := contentRangeTotal(resp.Header.Get("Content-Range")); t == fileSize {
+			total = t
+			return nil
+		}
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	case resp.StatusCode == http.StatusOK:
+		start = 0
+		total = resp.ContentLength
+	default:
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if start == 0 {
+		err := os.Truncate(file, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if total > 0 {
+		if err := checkFreeSpace(total - start); err != nil {
+			return err
+		}
+	}
 	done := make(chan bool)
 	defer close(done)
 	go func() {
@@ -275,23 +213,28 @@ func downloadFile(ctx context.Context, url, file string, progChan chan progress)
 			}
 		}
 	}()
-	_, err = io.Copy(f, resp.Body)
-	return err
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		return err
+	}
+	if total > 0 && start+n != total {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
 }
 
-func updateImageButtonText() {
-	var size int64
-	filepath.Walk(imageDir, func(_ string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-	if size == 0 {
-		imageButton.SetText("GET IMAGE...")
-	} else {
-		imageButton.SetText(fmt.Sprintf("IMG (%s)", formatSize(size)))
+// contentRangeTotal returns the complete length in a Content-Range header
+// like "bytes 100-199/200" or "bytes */200", or -1 if it is unknown.
+func contentRangeTotal(header string) int64 {
+	i := strings.LastIndex(header, "/")
+	if i < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(strings.TrimSpace(header[i+1:]), 10, 64)
+	if err != nil {
+		return -1
 	}
+	return total
 }
 
 func formatSize(b int64) string {
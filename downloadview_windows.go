@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+var (
+	progressBar    *walk.ProgressBar
+	urlComboBox    *walk.ComboBox
+	downloadButton *walk.PushButton
+	downloadStatus *walk.TextLabel
+	cancelDownload func()
+)
+
+func showDownloader() {
+	os.MkdirAll(imageDir, 0755)
+	var downloader *walk.Dialog
+	absPath, _ := filepath.Abs(imageDir)
+	truncated := truncatePath(absPath, 30)
+	Dialog{
+		AssignTo:  &downloader,
+		Layout:    VBox{},
+		Title:     "Downloader",
+		MinSize:   Size{500, 120},
+		FixedSize: true,
+		Children: []Widget{
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "Location:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					Composite{
+						StretchFactor: 5,
+						Layout: HBox{
+							MarginsZero: true,
+							SpacingZero: true,
+						},
+						Children: []Widget{
+							LinkLabel{
+								MaxSize: Size{
+									Height: 12,
+								},
+								Alignment:   AlignHNearVCenter,
+								ToolTipText: absPath,
+								Text:        fmt.Sprintf(`<a href="%s">%s</a>`, absPath, truncated),
+								OnLinkActivated: func(link *walk.LinkLabelLink) {
+									exec.Command("explorer.exe", link.URL()).Run()
+								},
+							},
+							HSpacer{},
+							LinkLabel{
+								MaxSize: Size{
+									Height: 12,
+								},
+								Alignment: AlignHFarVCenter,
+								Text:      "<a>Manage images</a>",
+								OnLinkActivated: func(_ *walk.LinkLabelLink) {
+									showImageStore(downloader)
+								},
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "Source:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					Composite{
+						StretchFactor: 5,
+						Layout: HBox{
+							MarginsZero: true,
+						},
+						Children: []Widget{
+							ComboBox{
+								AssignTo:     &urlComboBox,
+								CurrentIndex: 0,
+								MaxSize: Size{
+									Width: 1,
+								},
+								Model: []string{
+									"https://zima.oss-cn-hongkong.aliyuncs.com/images/zima/SW_SD5300_V046_A03_fastboot.zip",
+								},
+								Editable: true,
+							},
+							LinkLabel{
+								Text: "<a>File</a>",
+								OnLinkActivated: func(_ *walk.LinkLabelLink) {
+									dlg := new(walk.FileDialog)
+									dlg.Filter = "Image archives (*.zip;*.tar;*.tgz;*.tar.gz;*.txz;*.tar.xz;*.tzst;*.tar.zst)|*.zip;*.tar;*.tgz;*.tar.gz;*.txz;*.tar.xz;*.tzst;*.tar.zst"
+									dlg.Title = "Select an image archive"
+									if ok, _ := dlg.ShowOpen(downloader); ok {
+										urlComboBox.SetText(dlg.FilePath)
+									}
+								},
+							},
+							LinkLabel{
+								Text: "<a>Folder</a>",
+								OnLinkActivated: func(_ *walk.LinkLabelLink) {
+									dlg := new(walk.FileDialog)
+									dlg.Title = "Select an image folder"
+									if ok, _ := dlg.ShowBrowseFolder(downloader); ok {
+										urlComboBox.SetText(dlg.FilePath)
+									}
+								},
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						StretchFactor: 1,
+					},
+					HSplitter{
+						StretchFactor: 5,
+						Children: []Widget{
+							PushButton{
+								AssignTo: &downloadButton,
+								Text:     "DOWNLOAD",
+								OnClicked: func() {
+									download()
+								},
+							},
+							TextLabel{
+								AssignTo:      &downloadStatus,
+								TextAlignment: AlignHNearVCenter,
+								Text:          "Ready",
+								StretchFactor: 3,
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "Progress:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					Composite{
+						StretchFactor: 5,
+						Layout: VBox{
+							MarginsZero: true,
+						},
+						Children: []Widget{
+							ProgressBar{
+								AssignTo: &progressBar,
+								MaxValue: 10000,
+								MinValue: 0,
+							},
+						},
+					},
+				},
+			},
+		},
+	}.Create(md)
+	updateDialog(downloader)
+	imageProgress = func(value int, status string) {
+		progressBar.SetValue(value)
+		downloadStatus.SetText(status)
+	}
+	downloader.Run()
+	imageProgress = func(int, string) {}
+	if cancelDownload != nil {
+		cancelDownload()
+	}
+	go updateImageButtonText()
+}
+
+func download() {
+	if cancelDownload != nil {
+		cancelDownload()
+		cancelDownload = nil
+		downloadButton.SetText("DOWNLOAD")
+		return
+	}
+	src := strings.TrimSpace(urlComboBox.Text())
+	id := imageID(src)
+	file := partialPath(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelDownload = cancel
+	downloadButton.SetText("STOP")
+	fetch := func() error {
+		var progChan chan progress
+		if !isLocalSource(src) {
+			progChan = make(chan progress)
+			go showDownloadProgress(progChan)
+		}
+		return fetchImage(ctx, src, progChan)
+	}
+	go func() {
+		err := fetch()
+		for {
+			var spaceErr *insufficientSpaceError
+			if !errors.As(err, &spaceErr) || !askToRemoveCachedImages(spaceErr, file) {
+				break
+			}
+			err = fetch()
+		}
+		if err != nil && err != context.Canceled {
+			if !isLocalSource(src) {
+				os.Remove(file)
+			}
+			walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		}
+		if err == nil {
+			err = addImage(id, src)
+		}
+		if err == nil {
+			downloadStatus.SetText("Done")
+		}
+		cancelDownload = nil
+		downloadButton.SetText("DOWNLOAD")
+	}()
+}
+
+func showDownloadProgress(progChan chan progress) {
+	var first int64 = -1
+	var begin time.Time
+	for prog := range progChan {
+		if first < 0 {
+			first, begin = prog.downloaded, time.Now()
+		}
+		speed := ""
+		if secs := time.Since(begin).Seconds(); secs > 1 {
+			speed = fmt.Sprintf(" (%s/s)", formatSize(int64(float64(prog.downloaded-first)/secs)))
+		}
+		if prog.total > 0 {
+			progressBar.SetMarqueeMode(false)
+			progressBar.SetValue(int(prog.downloaded * 10000 / prog.total))
+			downloadStatus.SetText(fmt.Sprintf("Received %s out of %s%s", formatSize(prog.downloaded), formatSize(prog.total), speed))
+		} else {
+			progressBar.SetMarqueeMode(true)
+			downloadStatus.SetText(fmt.Sprintf("Received %s%s", formatSize(prog.downloaded), speed))
+		}
+	}
+	progressBar.SetMarqueeMode(false)
+}
+
+// askToRemoveCachedImages offers to delete the images already downloaded
+// to make room and returns true if they have been deleted.
+func askToRemoveCachedImages(spaceErr *insufficientSpaceError, keep ...string) bool {
+	ret := walk.MsgBox(md, "Not Enough Disk Space",
+		spaceErr.Error()+"\r\n\r\nDo you want to delete the images downloaded before to make room?",
+		walk.MsgBoxYesNo|walk.MsgBoxIconExclamation|walk.MsgBoxDefButton2,
+	)
+	if ret != walk.DlgCmdYes {
+		return false
+	}
+	if err := removeCachedImages(keep...); err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return false
+	}
+	return true
+}
+
+func updateImageButtonText() {
+	var size int64
+	if dir := currentImageDir(); dir != imageDir {
+		size = dirSize(dir)
+	} else if infos, err := ioutil.ReadDir(imageDir); err == nil {
+		// image files extracted by older versions
+		for _, info := range infos {
+			if !info.IsDir() && info.Name() != "images.json" && !strings.HasSuffix(info.Name(), partialSuffix) {
+				size += info.Size()
+			}
+		}
+	}
+	if size == 0 {
+		imageButton.SetText("GET IMAGE...")
+	} else {
+		imageButton.SetText(fmt.Sprintf("IMG (%s)", formatSize(size)))
+	}
+}
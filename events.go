@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+
+	// the oldest events are dropped when there are more
+	maxEvents = 20000
+
+	// the output of a command that is kept to check for errors
+	maxCommandOutput = 64 * 1024
+)
+
+var (
+	levelRanks = map[string]int{
+		levelDebug: 0,
+		levelInfo:  1,
+		levelWarn:  2,
+		levelError: 3,
+	}
+)
+
+// logEvent is an entry of the event log. Events of operations are
+// attributed to the device and the step they belong to, the others come
+// from the log package.
+type logEvent struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Device    string    `json:"device,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	Step      string    `json:"step,omitempty"`
+	Message   string    `json:"message"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+}
+
+// String formats the event as a line of the console, like
+// "15:04:05 [192.168.1.5:5555] adb install: Success".
+func (e logEvent) String() string {
+	s := e.Time.Format("15:04:05")
+	if e.Device != "" {
+		s += " [" + e.Device + "]"
+	}
+	if e.Step != "" {
+		s += " " + e.Step + ":"
+	}
+	return s + " " + e.Message
+}
+
+// eventLog keeps the recent events in memory and notifies its listeners of
+// new ones.
+type eventLog struct {
+	mutex     sync.Mutex
+	events    []logEvent
+	listeners map[int]func(logEvent)
+	next      int
+}
+
+var events = &eventLog{}
+
+func (l *eventLog) add(e logEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Level == "" {
+		e.Level = levelInfo
+	}
+	l.mutex.Lock()
+	if len(l.events) >= maxEvents {
+		l.events = append([]logEvent{}, l.events[maxEvents/10:]...)
+	}
+	l.events = append(l.events, e)
+	var listeners []func(logEvent)
+	for _, f := range l.listeners {
+		listeners = append(listeners, f)
+	}
+	l.mutex.Unlock()
+	for _, f := range listeners {
+		f(e)
+	}
+}
+
+// subscribe calls f with every new event until the returned function is
+// called.
+func (l *eventLog) subscribe(f func(logEvent)) (unsubscribe func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.listeners == nil {
+		l.listeners = map[int]func(logEvent){}
+	}
+	id := l.next
+	l.next++
+	l.listeners[id] = f
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		delete(l.listeners, id)
+	}
+}
+
+func (l *eventLog) list() []logEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]logEvent{}, l.events...)
+}
+
+// export writes the events matching filter as JSON Lines.
+func (l *eventLog) export(w io.Writer, filter func(logEvent) bool) error {
+	enc := json.NewEncoder(w)
+	for _, e := range l.list() {
+		if filter != nil && !filter(e) {
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logWriter turns the messages of the log package into events.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	events.add(logEvent{Message: strings.TrimRight(string(p), "\r\n")})
+	return len(p), nil
+}
+
+// operation attributes the events of the steps of an operation, like an
+// install, to the device it operates on.
+type operation struct {
+	Name   string
+	Device string
+}
+
+func (o *operation) log(level, step, message string, exitCode *int) {
+	events.add(logEvent{
+		Level:     level,
+		Device:    o.Device,
+		Operation: o.Name,
+		Step:      step,
+		Message:   message,
+		ExitCode:  exitCode,
+	})
+}
+
+// command runs a program like adb, logging its output as events of the step
+// and passing every line to output if it is not nil. The program and all of
+// its children are killed when ctx is done.
+func (o *operation) command(ctx context.Context, output func(string), exe string, args ...string) (string, error) {
+	step := stepName(exe, args)
+	name, a := toolCommand(exe, args...)
+	cmd := exec.Command(name, a...)
+	hideWindow(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessTree(cmd.Process.Pid)
+		case <-done:
+		}
+	}()
+	var out strings.Builder
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	read := func(r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				continue
+			}
+			o.log(levelInfo, step, line, nil)
+			mutex.Lock()
+			if output != nil {
+				output(line)
+			}
+			if out.Len() < maxCommandOutput {
+				out.WriteString(line + "\n")
+			}
+			mutex.Unlock()
+		}
+	}
+	wg.Add(2)
+	go read(stdout)
+	go read(stderr)
+	wg.Wait()
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return out.String(), ctx.Err()
+	}
+	if err != nil {
+		if code := cmd.ProcessState.ExitCode(); code > 0 {
+			commandFailures.inc(o.Name, step, deviceModel(o.Device), strconv.Itoa(code))
+			return out.String(), &commandError{Command: step, ExitCode: code}
+		}
+		return out.String(), err
+	}
+	return out.String(), nil
+}
+
+// stepName names the step running a program, like "adb install" for
+// lib\adb.exe -s 192.168.1.5:5555 install -r app.apk or "fastboot flash
+// system" for fastboot.exe flash -S 500M system system.img.
+func stepName(name string, args []string) string {
+	step := strings.TrimSuffix(filepath.Base(name), ".exe")
+	words := 0
+	for i := 0; i < len(args) && words < 2; i++ {
+		arg := args[i]
+		if arg == "-s" || arg == "-S" {
+			i++ // skip the value
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if strings.ContainsAny(arg, `\/`) {
+			break
+		}
+		step += " " + arg
+		words++
+	}
+	return step
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/lxn/walk"
+)
+
+var (
+	consoleLevels  = []string{"Debug", "Info", "Warnings", "Errors"}
+	consoleDevices = []string{"All devices"}
+)
+
+// consoleFilter returns whether an event is shown in the console with the
+// current filters.
+func consoleFilter() func(logEvent) bool {
+	minLevel := levelFilter.CurrentIndex()
+	device := ""
+	if i := deviceFilter.CurrentIndex(); i > 0 && i < len(consoleDevices) {
+		device = consoleDevices[i]
+	}
+	text := strings.ToLower(strings.TrimSpace(textFilter.Text()))
+	return func(e logEvent) bool {
+		if levelRanks[e.Level] < minLevel {
+			return false
+		}
+		if device != "" && e.Device != device {
+			return false
+		}
+		if text != "" && !strings.Contains(strings.ToLower(e.String()), text) {
+			return false
+		}
+		return true
+	}
+}
+
+// renderConsole shows the events matching the filters in the console.
+func renderConsole() {
+	if console == nil || levelFilter == nil || deviceFilter == nil || textFilter == nil {
+		return // still being created
+	}
+	filter := consoleFilter()
+	var lines []string
+	for _, e := range events.list() {
+		if filter(e) {
+			lines = append(lines, consoleLine(e))
+		}
+	}
+	console.SetText(strings.Join(lines, ""))
+	console.SetTextSelection(console.TextLength(), console.TextLength())
+	console.ScrollToCaret()
+}
+
+// showEvent appends a new event to the console if it matches the filters.
+func showEvent(e logEvent) {
+	if console == nil {
+		return
+	}
+	if e.Device != "" && !containsString(consoleDevices, e.Device) {
+		consoleDevices = append(consoleDevices, e.Device)
+		index := deviceFilter.CurrentIndex()
+		deviceFilter.SetModel(consoleDevices)
+		deviceFilter.SetCurrentIndex(index)
+	}
+	if consoleFilter()(e) {
+		console.AppendText(consoleLine(e))
+	}
+}
+
+func consoleLine(e logEvent) string {
+	return strings.Replace(e.String(), "\n", "\r\n", -1) + "\r\n"
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// saveSessionLog saves the complete log of this session.
+func saveSessionLog() {
+	if session == nil {
+		return
+	}
+	dlg := new(walk.FileDialog)
+	dlg.Filter = "JSON Lines (*.jsonl)|*.jsonl"
+	dlg.Title = "Save Log"
+	dlg.FilePath = session.name + logFileExt
+	if ok, _ := dlg.ShowSave(md); !ok {
+		return
+	}
+	f, err := os.Create(dlg.FilePath)
+	if err == nil {
+		err = session.save(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+	}
+}
+
+// exportEvents saves the events matching the filters as JSON Lines, to be
+// attached to support tickets.
+func exportEvents() {
+	dlg := new(walk.FileDialog)
+	dlg.Filter = "JSON Lines (*.jsonl)|*.jsonl"
+	dlg.Title = "Export Log"
+	dlg.FilePath = "adbinstall-log.jsonl"
+	if ok, _ := dlg.ShowSave(md); !ok {
+		return
+	}
+	path := dlg.FilePath
+	if !strings.HasSuffix(strings.ToLower(path), ".jsonl") {
+		path += ".jsonl"
+	}
+	f, err := os.Create(path)
+	if err == nil {
+		err = events.export(f, consoleFilter())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+	}
+}
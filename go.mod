@@ -1,9 +1,14 @@
 module github.com/caiguanhao/adbinstall
 
-go 1.15
+go 1.16
 
 require (
+	github.com/klauspost/compress v1.11.7
 	github.com/lxn/walk v0.0.0-20210112085537-c389da54e794
 	github.com/lxn/win v0.0.0-20201111105847-2a20daff6a55
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/net v0.7.0
 	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runGUI points to the web UI, the GUI is only available on Windows.
+func runGUI() {
+	fmt.Fprint(os.Stderr, "The GUI is only available on Windows, start the web UI with adbinstall daemon.\n\n"+cliUsage)
+	os.Exit(2)
+}
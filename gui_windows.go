@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+	"github.com/lxn/win"
+)
+
+var (
+	md            *walk.Dialog
+	adbAddress    *walk.ComboBox
+	scanButton    *walk.LinkLabel
+	console       *walk.TextEdit
+	viewButton    *walk.PushButton
+	imageButton   *walk.PushButton
+	flashButton   *walk.PushButton
+	stopButton    *walk.PushButton
+	queueLabel    *walk.TextLabel
+	apkLinkLabel  *walk.LinkLabel
+	apkFilePaths  []string
+	openButton    *walk.PushButton
+	installButton *walk.PushButton
+	installedPkgs *walk.ComboBox
+	reloadButton  *walk.PushButton
+	uninstallBtn  *walk.PushButton
+	deviceTable   *walk.TableView
+	levelFilter   *walk.ComboBox
+	deviceFilter  *walk.ComboBox
+	textFilter    *walk.LineEdit
+
+	cancelScan func()
+)
+
+// runGUI shows the main window.
+func runGUI() {
+	windowTitle := fmt.Sprintf("Android Updater (ver %s)", version)
+	if alreadyRunning() {
+		win.SetForegroundWindow(win.FindWindow(nil, syscall.StringToUTF16Ptr(windowTitle)))
+		return
+	}
+	if loadConfig().AuditLogin && !login() {
+		return
+	}
+	startSessionLog()
+	defer session.close()
+	Dialog{
+		AssignTo:  &md,
+		Layout:    VBox{},
+		Title:     windowTitle,
+		MinSize:   Size{600, 520},
+		FixedSize: true,
+		Children: []Widget{
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "ADB address:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					Composite{
+						StretchFactor: 5,
+						Layout: HBox{
+							Margins: Margins{
+								Top: 1,
+							},
+						},
+						Children: []Widget{
+							ComboBox{
+								AssignTo: &adbAddress,
+								Editable: true,
+							},
+							LinkLabel{
+								AssignTo:      &scanButton,
+								StretchFactor: 1,
+								Text:          "<a>Scan</a>",
+								OnLinkActivated: func(_ *walk.LinkLabelLink) {
+									scan()
+								},
+							},
+							LinkLabel{
+								StretchFactor: 1,
+								Text:          "<a>Options</a>",
+								OnLinkActivated: func(_ *walk.LinkLabelLink) {
+									showScanOptions()
+								},
+							},
+							LinkLabel{
+								StretchFactor: 1,
+								Text:          "<a>Pair</a>",
+								OnLinkActivated: func(_ *walk.LinkLabelLink) {
+									showPairing()
+								},
+							},
+							LinkLabel{
+								StretchFactor: 1,
+								Text:          "<a>Devices</a>",
+								OnLinkActivated: func(_ *walk.LinkLabelLink) {
+									showInventory()
+								},
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						StretchFactor: 1,
+					},
+					HSplitter{
+						StretchFactor: 5,
+						Children: []Widget{
+							PushButton{
+								AssignTo: &viewButton,
+								Text:     "VIEW",
+								OnClicked: func() {
+									start()
+								},
+							},
+							PushButton{
+								AssignTo: &imageButton,
+								Text:     "IMAGE...",
+								OnClicked: func() {
+									showDownloader()
+								},
+							},
+							PushButton{
+								AssignTo: &flashButton,
+								Text:     "FLASH",
+								OnClicked: func() {
+									flash()
+								},
+							},
+							PushButton{
+								Text: "RECIPE...",
+								OnClicked: func() {
+									runRecipe()
+								},
+							},
+							PushButton{
+								AssignTo: &stopButton,
+								Text:     "STOP",
+								Enabled:  false,
+								OnClicked: func() {
+									stop()
+								},
+							},
+							TextLabel{
+								AssignTo:      &queueLabel,
+								StretchFactor: 1,
+								TextAlignment: AlignHNearVCenter,
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "APK files:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					HSplitter{
+						StretchFactor: 5,
+						Children: []Widget{
+							LinkLabel{
+								AssignTo:      &apkLinkLabel,
+								StretchFactor: 1,
+								Text:          "No file selected",
+								OnLinkActivated: func(link *walk.LinkLabelLink) {
+									exec.Command("explorer.exe", "/select,", link.URL()).Run()
+								},
+							},
+							TextLabel{
+								StretchFactor: 1,
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						StretchFactor: 1,
+					},
+					HSplitter{
+						StretchFactor: 5,
+						Children: []Widget{
+							PushButton{
+								AssignTo: &openButton,
+								Text:     "SELECT...",
+								OnClicked: func() {
+									openFile()
+								},
+							},
+							PushButton{
+								AssignTo: &installButton,
+								Text:     "INSTALL",
+								OnClicked: func() {
+									install()
+								},
+							},
+							TextLabel{
+								StretchFactor: 3,
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "Installed Packages:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					Composite{
+						StretchFactor: 5,
+						Layout: VBox{
+							Margins: Margins{
+								Top: 1,
+							},
+						},
+						Children: []Widget{
+							ComboBox{
+								AssignTo: &installedPkgs,
+								OnCurrentIndexChanged: func() {
+									uninstallBtn.SetEnabled(installedPkgs.Text() != "")
+								},
+							},
+						},
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						StretchFactor: 1,
+					},
+					HSplitter{
+						StretchFactor: 5,
+						Children: []Widget{
+							PushButton{
+								AssignTo: &reloadButton,
+								Text:     "RELOAD",
+								OnClicked: func() {
+									reload()
+								},
+							},
+							PushButton{
+								AssignTo: &uninstallBtn,
+								Text:     "UNINSTALL",
+								OnClicked: func() {
+									uninstall()
+								},
+							},
+							PushButton{
+								Text: "PACKAGES...",
+								OnClicked: func() {
+									showPackages()
+								},
+							},
+							TextLabel{
+								StretchFactor: 2,
+							},
+						},
+					},
+				},
+			},
+			TableView{
+				AssignTo: &deviceTable,
+				MinSize:  Size{Height: 90},
+				MaxSize:  Size{Height: 90},
+				Columns: []TableViewColumn{
+					{Title: "Device", DataMember: "Serial", Width: 170},
+					{Title: "State", DataMember: "State", Width: 90},
+					{Title: "Model", DataMember: "Model", Width: 140},
+					{Title: "Product", DataMember: "Product", Width: 120},
+				},
+				OnItemActivated: func() {
+					useSelectedDevice()
+				},
+			},
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					ComboBox{
+						AssignTo:              &levelFilter,
+						Model:                 consoleLevels,
+						CurrentIndex:          1,
+						OnCurrentIndexChanged: renderConsole,
+					},
+					ComboBox{
+						AssignTo:              &deviceFilter,
+						Model:                 consoleDevices,
+						CurrentIndex:          0,
+						OnCurrentIndexChanged: renderConsole,
+					},
+					LineEdit{
+						AssignTo:      &textFilter,
+						CueBanner:     "Filter",
+						OnTextChanged: renderConsole,
+					},
+					LinkLabel{
+						Text: "<a>Export</a>",
+						OnLinkActivated: func(_ *walk.LinkLabelLink) {
+							exportEvents()
+						},
+					},
+					LinkLabel{
+						Text: "<a>Save log</a>",
+						OnLinkActivated: func(_ *walk.LinkLabelLink) {
+							saveSessionLog()
+						},
+					},
+					LinkLabel{
+						Text: "<a>Audit</a>",
+						OnLinkActivated: func(_ *walk.LinkLabelLink) {
+							exportAuditLog()
+						},
+					},
+					LinkLabel{
+						Text: "<a>Log folder</a>",
+						OnLinkActivated: func(_ *walk.LinkLabelLink) {
+							exec.Command("explorer.exe", logDir()).Run()
+						},
+					},
+				},
+			},
+			TextEdit{
+				AssignTo: &console,
+				VScroll:  true,
+				ReadOnly: true,
+			},
+			LinkLabel{
+				Alignment: AlignHFarVCenter,
+				Text:      `<a href="https://github.com/caiguanhao/adbinstall">View Source</a>`,
+				OnLinkActivated: func(link *walk.LinkLabelLink) {
+					exec.Command("explorer.exe", link.URL()).Run()
+				},
+			},
+		},
+	}.Create(nil)
+	updateDialog(md)
+	events.subscribe(func(e logEvent) {
+		md.Synchronize(func() { showEvent(e) })
+	})
+	renderConsole()
+	go updateImageButtonText()
+	monitor.subscribe(func(e deviceEvent) {
+		md.Synchronize(updateDeviceTable)
+		recordDeviceEvent(e)
+	})
+	adbAddress.SetModel(inventoryAddresses())
+	go monitor.run(context.Background())
+	queue.subscribe(func() {
+		md.Synchronize(updateQueueState)
+	})
+	md.Run()
+	killOwnADBServer()
+}
+
+func updateDialog(d *walk.Dialog) {
+	dpi := float64(d.DPI()) / 96
+	screenWidth := int(float64(win.GetSystemMetrics(win.SM_CXSCREEN)) / dpi)
+	screenHeight := int(float64(win.GetSystemMetrics(win.SM_CYSCREEN)) / dpi)
+	d.SetX((screenWidth - d.MinSize().Width) / 2)
+	d.SetY((screenHeight - d.MinSize().Height) / 2)
+	icon, _ := walk.NewIconFromResourceId(2)
+	if icon != nil {
+		d.SetIcon(icon)
+	}
+}
+
+// updateQueueState shows how many jobs are running and waiting. The images
+// can't be changed while a device is being flashed with them.
+func updateQueueState() {
+	running, queued := queue.counts()
+	text := ""
+	if running > 0 {
+		text = fmt.Sprintf("%d running", running)
+		if queued > 0 {
+			text += fmt.Sprintf(", %d queued", queued)
+		}
+	}
+	queueLabel.SetText(text)
+	stopButton.SetEnabled(running+queued > 0)
+	flashing := false
+	for _, j := range queue.jobs() {
+		if j.Name == "flash" {
+			flashing = true
+		}
+	}
+	imageButton.SetEnabled(!flashing)
+}
+
+// runJobs queues jobs on their devices. then is called on the GUI thread if
+// all of them succeed.
+func runJobs(then func(), jobs ...*job) {
+	go func() {
+		if queue.wait(jobs...) && then != nil {
+			md.Synchronize(then)
+		}
+	}()
+}
+
+func stop() {
+	queue.cancelAll()
+}
+
+func start() {
+	text := adbAddress.Text()
+	if isTargetSet(text) {
+		walk.MsgBox(md, "Error", "Please select a single device instead of "+text, walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	runJobs(nil, viewJob(addressOf(text)))
+}
+
+func flash() {
+	text := adbAddress.Text()
+	if isTargetSet(text) {
+		walk.MsgBox(md, "Error", "Please select a single device instead of "+text, walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	ret := walk.MsgBox(md, "Flash Image",
+		"Are you sure you want to flash image to the Android device? This will delete everything on the device!",
+		walk.MsgBoxYesNo|walk.MsgBoxIconExclamation|walk.MsgBoxDefButton2,
+	)
+	if ret != walk.DlgCmdYes {
+		return
+	}
+	dir := currentImageDir()
+	markImageUsed()
+	j := flashJob(addressOf(text), dir)
+	runJobs(nil, j)
+	showProgress("Flash Image", []*job{j})
+}
+
+// runRecipe runs a recipe file on the device or set of devices in the
+// address box.
+func runRecipe() {
+	dlg := new(walk.FileDialog)
+	dlg.Filter = "Recipes (*.yaml;*.yml;*.json)|*.yaml;*.yml;*.json"
+	dlg.Title = "Select a recipe"
+	if ok, _ := dlg.ShowOpen(md); !ok {
+		return
+	}
+	r, err := loadRecipe(dlg.FilePath)
+	if err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	targets, set, err := resolveTargets(adbAddress.Text())
+	if err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	var jobs []*job
+	for _, target := range targets {
+		j, err := recipeJob(r, target, nil)
+		if err != nil {
+			walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	devices := "the Android device"
+	if set {
+		devices = fmt.Sprintf("%d devices", len(jobs))
+	}
+	text := fmt.Sprintf("Are you sure you want to run %s (%d steps) on %s?", r.Name, len(r.Steps), devices)
+	icon := walk.MsgBoxIconQuestion
+	if r.flashes() {
+		text += " It flashes the image, which will delete everything on the device!"
+		icon = walk.MsgBoxIconExclamation
+	}
+	if walk.MsgBox(md, "Run Recipe", text, walk.MsgBoxYesNo|icon|walk.MsgBoxDefButton2) != walk.DlgCmdYes {
+		return
+	}
+	runJobs(nil, jobs...)
+	showProgress(r.Name, jobs)
+}
+
+func openFile() {
+	dlg := new(walk.FileDialog)
+	dlg.Filter = "APK (*.apk)|*.apk"
+	dlg.Title = "Select an APK"
+	dlg.ShowOpenMultiple(md)
+	apkFilePaths = dlg.FilePaths[:]
+	if len(apkFilePaths) > 0 {
+		text := ""
+		for i, p := range apkFilePaths {
+			if i > 1 {
+				text += fmt.Sprintf(" and %d file(s)", len(apkFilePaths)-i)
+				break
+			} else if i > 0 {
+				text += ", "
+			}
+			text += fmt.Sprintf(`<a href="%s">%s</a>`, p, filepath.Base(p))
+		}
+		apkLinkLabel.SetText(text)
+	} else {
+		apkLinkLabel.SetText("No file selected")
+	}
+	installButton.SetEnabled(len(apkFilePaths) > 0)
+}
+
+func install() {
+	targets, set, err := resolveTargets(adbAddress.Text())
+	if err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	var jobs []*job
+	for _, target := range targets {
+		jobs = append(jobs, installJob(target, apkFilePaths))
+	}
+	runJobs(func() {
+		if !set {
+			reload()
+		}
+	}, jobs...)
+	showProgress("Install", jobs)
+}
+
+func reload() {
+	text := adbAddress.Text()
+	if isTargetSet(text) {
+		return
+	}
+	runJobs(nil, packagesJob(addressOf(text), func(pkgs []string) {
+		md.Synchronize(func() {
+			installedPkgs.SetModel(pkgs)
+			installedPkgs.SetCurrentIndex(0)
+		})
+	}))
+}
+
+func uninstall() {
+	targets, set, err := resolveTargets(adbAddress.Text())
+	if err != nil {
+		walk.MsgBox(md, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	pkg := strings.TrimSpace(installedPkgs.Text())
+	var jobs []*job
+	for _, target := range targets {
+		jobs = append(jobs, uninstallJob(target, pkg, false))
+	}
+	runJobs(func() {
+		if !set {
+			reload()
+		}
+	}, jobs...)
+}
+
+func alreadyRunning() bool {
+	procCreateMutex := kernel32.NewProc("CreateMutexW")
+	_, _, err := procCreateMutex.Call(0, 0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr("adbinstall"))))
+	return int(err.(syscall.Errno)) != 0
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every image is extracted into its own directory under imageDir, named by
+// imageID. Partial downloads are kept next to it with a ".part" suffix and
+// the images known to the store are recorded in images.json.
+
+const partialSuffix = ".part"
+
+var (
+	imageIndexMutex = &sync.Mutex{}
+
+	archiveExts = []string{".tar.gz", ".tar.xz", ".tar.zst", ".tgz", ".txz", ".tzst", ".tar", ".zip"}
+)
+
+type imageInfo struct {
+	Source   string    `json:"source"`
+	Added    time.Time `json:"added"`
+	LastUsed time.Time `json:"last_used"`
+	Keep     bool      `json:"keep"`
+}
+
+type imageIndex struct {
+	Current  string                `json:"current"`
+	KeepLast int                   `json:"keep_last"`
+	Images   map[string]*imageInfo `json:"images"`
+}
+
+// storeEntry is a row in the image management view.
+type storeEntry struct {
+	Name     string
+	Kind     string
+	Size     string
+	LastUsed string
+	Keep     string
+
+	path    string
+	id      string
+	current bool
+}
+
+func imageIndexFile() string {
+	return filepath.Join(imageDir, "images.json")
+}
+
+func loadImageIndex() *imageIndex {
+	idx := &imageIndex{}
+	if b, err := ioutil.ReadFile(imageIndexFile()); err == nil {
+		json.Unmarshal(b, idx)
+	}
+	if idx.Images == nil {
+		idx.Images = map[string]*imageInfo{}
+	}
+	return idx
+}
+
+func (idx *imageIndex) save() error {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(imageIndexFile(), b, 0644)
+}
+
+func updateImageIndex(f func(idx *imageIndex)) error {
+	imageIndexMutex.Lock()
+	defer imageIndexMutex.Unlock()
+	idx := loadImageIndex()
+	f(idx)
+	return idx.save()
+}
+
+// imageID derives the name of an image from its URL or file path, e.g.
+// "SW_SD5300_V046_A03_fastboot" for ".../SW_SD5300_V046_A03_fastboot.zip".
+func imageID(src string) string {
+	name := filepath.Base(src)
+	if !isLocalSource(src) {
+		if u, err := url.Parse(src); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+	name = regexp.MustCompile(`[^\w.-]+`).ReplaceAllString(name, "_")
+	name = strings.Trim(name, "._")
+	if name == "" {
+		name = "image"
+	}
+	// the index is in imageDir too
+	if strings.EqualFold(name, filepath.Base(imageIndexFile())) {
+		name += "_"
+	}
+	return name
+}
+
+func imagePath(id string) string {
+	return filepath.Join(imageDir, id)
+}
+
+func partialPath(id string) string {
+	return imagePath(id) + partialSuffix
+}
+
+// imageFilesDir returns the directory of an image that contains the files,
+// skipping the single top-level folder many archives wrap their files in.
+func imageFilesDir(dir string) string {
+	for {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+			return dir
+		}
+		dir = filepath.Join(dir, entries[0].Name())
+	}
+}
+
+// currentImageDir returns the directory of the image to flash. Images
+// downloaded by older versions were extracted into imageDir directly, which
+// is used when no image has been selected.
+func currentImageDir() string {
+	imageIndexMutex.Lock()
+	idx := loadImageIndex()
+	imageIndexMutex.Unlock()
+	if idx.Current != "" {
+		if fi, err := os.Stat(imagePath(idx.Current)); err == nil && fi.IsDir() {
+			return imageFilesDir(imagePath(idx.Current))
+		}
+	}
+	return imageDir
+}
+
+func addImage(id, src string) error {
+	return updateImageIndex(func(idx *imageIndex) {
+		now := time.Now()
+		info := &imageInfo{
+			Source:   src,
+			Added:    now,
+			LastUsed: now,
+		}
+		if old := idx.Images[id]; old != nil {
+			info.Keep = old.Keep
+		}
+		idx.Images[id] = info
+		idx.Current = id
+		gcImages(idx)
+	})
+}
+
+func useImage(id string) error {
+	return updateImageIndex(func(idx *imageIndex) {
+		if info := idx.Images[id]; info != nil {
+			idx.Current = id
+			info.LastUsed = time.Now()
+		}
+	})
+}
+
+func markImageUsed() error {
+	return updateImageIndex(func(idx *imageIndex) {
+		if info := idx.Images[idx.Current]; info != nil {
+			info.LastUsed = time.Now()
+		}
+	})
+}
+
+func setImageKeep(id string, keep bool) error {
+	return updateImageIndex(func(idx *imageIndex) {
+		if info := idx.Images[id]; info != nil {
+			info.Keep = keep
+		}
+	})
+}
+
+func setKeepLast(n int) error {
+	return updateImageIndex(func(idx *imageIndex) {
+		idx.KeepLast = n
+		gcImages(idx)
+	})
+}
+
+// gcImages deletes the least recently used images so that at most
+// idx.KeepLast of them are left. The current image and images marked to
+// keep are never deleted.
+func gcImages(idx *imageIndex) (removed []string) {
+	if idx.KeepLast <= 0 {
+		return
+	}
+	var ids []string
+	for id := range idx.Images {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return idx.Images[ids[i]].LastUsed.After(idx.Images[ids[j]].LastUsed)
+	})
+	for i, id := range ids {
+		if i < idx.KeepLast || id == idx.Current || idx.Images[id].Keep {
+			continue
+		}
+		if err := os.RemoveAll(imagePath(id)); err != nil {
+			continue
+		}
+		delete(idx.Images, id)
+		removed = append(removed, id)
+	}
+	return
+}
+
+func removeStoreEntry(e *storeEntry) error {
+	if err := os.RemoveAll(e.path); err != nil {
+		return err
+	}
+	if e.id == "" {
+		return nil
+	}
+	return updateImageIndex(func(idx *imageIndex) {
+		delete(idx.Images, e.id)
+		if idx.Current == e.id {
+			idx.Current = ""
+		}
+	})
+}
+
+// listStore returns the images, partial downloads and any other files
+// found in imageDir.
+func listStore() (entries []*storeEntry) {
+	// the files of an image unpacked in imageDir itself, as older versions
+	// did, are the current image until another one is used
+	legacy := currentImageDir() == imageDir
+	imageIndexMutex.Lock()
+	idx := loadImageIndex()
+	imageIndexMutex.Unlock()
+	infos, err := ioutil.ReadDir(imageDir)
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		p := filepath.Join(imageDir, name)
+		if p == imageIndexFile() {
+			continue
+		}
+		e := &storeEntry{
+			Name:     name,
+			Kind:     "Stray file",
+			Size:     formatSize(dirSize(p)),
+			LastUsed: fi.ModTime().Format("2006-01-02 15:04"),
+			path:     p,
+		}
+		if info := idx.Images[name]; info != nil && fi.IsDir() {
+			e.Kind = "Image"
+			e.id = name
+			e.LastUsed = info.LastUsed.Format("2006-01-02 15:04")
+			if info.Keep {
+				e.Keep = "Yes"
+			}
+			if name == idx.Current {
+				e.current = true
+				e.Kind = "Image (current)"
+			}
+		} else if strings.HasSuffix(name, partialSuffix) && !fi.IsDir() {
+			e.Kind = "Partial download"
+		} else if legacy && !fi.IsDir() {
+			e.current = true
+			e.Kind = "Image file (current)"
+		} else if fi.IsDir() {
+			e.Kind = "Stray folder"
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].id != "" && entries[j].id == ""
+	})
+	return
+}
+
+func dirSize(dir string) (size int64) {
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
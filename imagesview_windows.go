@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+func showImageStore(owner walk.Form) {
+	var dlg *walk.Dialog
+	var table *walk.TableView
+	var useButton, keepButton, deleteButton *walk.PushButton
+	var keepLast *walk.NumberEdit
+	entries := listStore()
+	imageIndexMutex.Lock()
+	idx := loadImageIndex()
+	imageIndexMutex.Unlock()
+	selected := func() *storeEntry {
+		i := table.CurrentIndex()
+		if i < 0 || i >= len(entries) {
+			return nil
+		}
+		return entries[i]
+	}
+	updateButtons := func() {
+		e := selected()
+		useButton.SetEnabled(e != nil && e.id != "" && !e.current)
+		keepButton.SetEnabled(e != nil && e.id != "")
+		if e != nil && e.Keep != "" {
+			keepButton.SetText("UNKEEP")
+		} else {
+			keepButton.SetText("KEEP")
+		}
+		deleteButton.SetEnabled(e != nil)
+	}
+	refresh := func() {
+		i := table.CurrentIndex()
+		entries = listStore()
+		table.SetModel(entries)
+		if i >= len(entries) {
+			i = len(entries) - 1
+		}
+		table.SetCurrentIndex(i)
+		updateButtons()
+		go updateImageButtonText()
+	}
+	showError := func(err error) {
+		if err != nil {
+			walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		}
+	}
+	Dialog{
+		AssignTo: &dlg,
+		Layout:   VBox{},
+		Title:    "Images",
+		MinSize:  Size{600, 320},
+		Children: []Widget{
+			TableView{
+				AssignTo: &table,
+				Columns: []TableViewColumn{
+					{Title: "Name", DataMember: "Name", Width: 220},
+					{Title: "Type", DataMember: "Kind", Width: 110},
+					{Title: "Size", DataMember: "Size", Width: 80, Alignment: AlignFar},
+					{Title: "Last Used", DataMember: "LastUsed", Width: 110},
+					{Title: "Keep", DataMember: "Keep", Width: 40},
+				},
+				Model:                 entries,
+				OnCurrentIndexChanged: func() { updateButtons() },
+			},
+			HSplitter{
+				Children: []Widget{
+					PushButton{
+						AssignTo: &useButton,
+						Text:     "USE",
+						OnClicked: func() {
+							if e := selected(); e != nil {
+								showError(useImage(e.id))
+								refresh()
+							}
+						},
+					},
+					PushButton{
+						AssignTo: &keepButton,
+						Text:     "KEEP",
+						OnClicked: func() {
+							if e := selected(); e != nil {
+								showError(setImageKeep(e.id, e.Keep == ""))
+								refresh()
+							}
+						},
+					},
+					PushButton{
+						AssignTo: &deleteButton,
+						Text:     "DELETE",
+						OnClicked: func() {
+							e := selected()
+							if e == nil {
+								return
+							}
+							ret := walk.MsgBox(dlg, "Delete",
+								fmt.Sprintf("Are you sure you want to delete %s (%s)?", e.Name, e.Size),
+								walk.MsgBoxYesNo|walk.MsgBoxIconExclamation|walk.MsgBoxDefButton2,
+							)
+							if ret != walk.DlgCmdYes {
+								return
+							}
+							showError(removeStoreEntry(e))
+							refresh()
+						},
+					},
+					TextLabel{
+						StretchFactor: 1,
+					},
+					TextLabel{
+						Text:          "Keep last",
+						TextAlignment: AlignHFarVCenter,
+					},
+					NumberEdit{
+						AssignTo:    &keepLast,
+						Value:       float64(idx.KeepLast),
+						MinValue:    0,
+						MaxValue:    100,
+						ToolTipText: "Number of images to keep, 0 to keep all",
+					},
+					PushButton{
+						Text: "APPLY",
+						OnClicked: func() {
+							showError(setKeepLast(int(keepLast.Value())))
+							refresh()
+						},
+					},
+				},
+			},
+		},
+	}.Create(owner)
+	updateDialog(dlg)
+	updateButtons()
+	dlg.Run()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func isLocalSource(src string) bool {
+	lower := strings.ToLower(src)
+	return !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://")
+}
+
+// importLocal extracts an image archive or copies an image directory from
+// local disk, e.g. a USB stick, into dest.
+func importLocal(ctx context.Context, src, dest string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return extractFile(ctx, src, dest)
+	}
+	return copyDir(ctx, src, dest)
+}
+
+func copyDir(ctx context.Context, dir, dest string) error {
+	var files []string
+	var sizes []uint64
+	var total uint64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			sizes = append(sizes, uint64(info.Size()))
+			total += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkFreeSpace(int64(total)); err != nil {
+		return err
+	}
+	if total == 0 {
+		total = 1
+	}
+	var done uint64
+	for i, path := range files {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		progChan := make(chan int64)
+		go func(done uint64) {
+			for c := range progChan {
+				imageProgress(int((done+uint64(c))*10000/total), "Copying "+rel)
+			}
+		}(done)
+		if err := copyFile(ctx, path, filepath.Join(dest, rel), progChan); err != nil {
+			return err
+		}
+		done += sizes[i]
+	}
+	return nil
+}
+
+func copyFile(ctx context.Context, src, dst string, progChan chan int64) error {
+	defer close(progChan)
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reportProgress := func() {
+		if fi, err := file.Stat(); err == nil {
+			progChan <- fi.Size()
+		}
+	}
+	defer reportProgress()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		t := time.Tick(100 * time.Millisecond)
+		for {
+			reportProgress()
+			select {
+			case <-done:
+				return
+			case <-t:
+			}
+		}
+	}()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(file, in)
+		errc <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errc:
+		return err
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	inventoryMutex = &sync.Mutex{}
+)
+
+// inventoryDevice is a device that has been connected to this computer.
+type inventoryDevice struct {
+	Serial         string            `json:"serial"`
+	Address        string            `json:"address,omitempty"`
+	Nickname       string            `json:"nickname,omitempty"`
+	Site           string            `json:"site,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+	Model          string            `json:"model,omitempty"`
+	AndroidVersion string            `json:"android_version,omitempty"`
+	LastSeen       time.Time         `json:"last_seen"`
+	Installed      map[string]string `json:"installed,omitempty"` // package -> version
+}
+
+// Target returns the serial adb knows the device by.
+func (d *inventoryDevice) Target() string {
+	if d.Address != "" {
+		return d.Address
+	}
+	return d.Serial
+}
+
+func (d *inventoryDevice) matches(query string) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return true
+	}
+	fields := append([]string{d.Serial, d.Address, d.Nickname, d.Site, d.Model, d.AndroidVersion}, d.Tags...)
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), query) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *inventoryDevice) hasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+type inventory struct {
+	Devices []*inventoryDevice `json:"devices"`
+}
+
+func inventoryFile() string {
+	return filepath.Join(dataDir, "devices.json")
+}
+
+func loadInventory() *inventory {
+	inventoryMutex.Lock()
+	defer inventoryMutex.Unlock()
+	return readInventory()
+}
+
+func readInventory() *inventory {
+	inv := &inventory{}
+	if b, err := ioutil.ReadFile(inventoryFile()); err == nil {
+		json.Unmarshal(b, inv)
+	}
+	return inv
+}
+
+func updateInventory(f func(inv *inventory)) error {
+	inventoryMutex.Lock()
+	defer inventoryMutex.Unlock()
+	inv := readInventory()
+	f(inv)
+	sort.Slice(inv.Devices, func(i, j int) bool {
+		return inv.Devices[i].LastSeen.After(inv.Devices[j].LastSeen)
+	})
+	b, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(inventoryFile(), b, 0644)
+}
+
+// find returns the device with the serial, or the device last seen at the
+// address.
+func (inv *inventory) find(serial string) *inventoryDevice {
+	for _, d := range inv.Devices {
+		if d.Serial == serial {
+			return d
+		}
+	}
+	for _, d := range inv.Devices {
+		if d.Address != "" && d.Address == serial {
+			return d
+		}
+	}
+	return nil
+}
+
+func (inv *inventory) search(query string) (devices []*inventoryDevice) {
+	for _, d := range inv.Devices {
+		if d.matches(query) {
+			devices = append(devices, d)
+		}
+	}
+	return
+}
+
+// resolveTargets returns the devices to operate on for the text in the
+// address box. It is either a single address or serial, or a set of devices
+// of the inventory like "tag:store-12" or "site:Shenzhen".
+func resolveTargets(text string) (targets []string, set bool, err error) {
+	text = strings.TrimSpace(text)
+	if !isTargetSet(text) {
+		return []string{addressOf(text)}, false, nil
+	}
+	var match func(d *inventoryDevice) bool
+	if strings.HasPrefix(text, "tag:") {
+		tag := strings.TrimSpace(strings.TrimPrefix(text, "tag:"))
+		match = func(d *inventoryDevice) bool { return d.hasTag(tag) }
+	} else {
+		site := strings.TrimSpace(strings.TrimPrefix(text, "site:"))
+		match = func(d *inventoryDevice) bool { return strings.EqualFold(d.Site, site) }
+	}
+	for _, d := range loadInventory().Devices {
+		if match(d) {
+			targets = append(targets, d.Target())
+		}
+	}
+	if len(targets) == 0 {
+		err = fmt.Errorf("no devices in the inventory match %s", text)
+	}
+	return targets, true, err
+}
+
+func isTargetSet(text string) bool {
+	text = strings.TrimSpace(text)
+	return strings.HasPrefix(text, "tag:") || strings.HasPrefix(text, "site:")
+}
+
+// defaultSerial returns serial, or the serial of the only connected device
+// if serial is empty, as adb does.
+func defaultSerial(serial string) string {
+	if serial != "" {
+		return serial
+	}
+	if devices := monitor.list(); len(devices) == 1 {
+		return devices[0].Serial
+	}
+	return ""
+}
+
+// recordDeviceEvent logs a change of a device and keeps the inventory up
+// to date with it.
+func recordDeviceEvent(e deviceEvent) {
+	logDeviceEvent(e)
+	if e.Kind == "removed" {
+		go recordDeviceGone(e.Device)
+	} else if e.Device.State == "device" {
+		go recordDevice(e.Device)
+	}
+}
+
+// recordDevice adds a device that has come online to the inventory or
+// refreshes what is known about it.
+func recordDevice(d deviceState) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, _ := toolOutput(ctx, libAdbExe, "-s", d.Serial, "shell",
+		"getprop ro.serialno; getprop ro.build.version.release")
+	lines := strings.Split(strings.Replace(string(out), "\r", "", -1), "\n")
+	serial, version := d.Serial, ""
+	if len(lines) >= 2 {
+		if s := strings.TrimSpace(lines[0]); s != "" {
+			serial = s
+		}
+		version = strings.TrimSpace(lines[1])
+	}
+	err := updateInventory(func(inv *inventory) {
+		device := inv.find(serial)
+		if device == nil {
+			device = inv.find(d.Serial)
+		}
+		if device == nil {
+			device = &inventoryDevice{Serial: serial}
+			inv.Devices = append(inv.Devices, device)
+			log.Println("added", serial, "to the inventory")
+		}
+		device.Serial = serial
+		if _, _, err := net.SplitHostPort(d.Serial); err == nil {
+			device.Address = d.Serial
+		}
+		if d.Model != "" {
+			device.Model = d.Model
+		}
+		if version != "" {
+			device.AndroidVersion = version
+		}
+		device.LastSeen = time.Now()
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func recordDeviceGone(d deviceState) {
+	updateInventory(func(inv *inventory) {
+		if device := inv.find(d.Serial); device != nil {
+			device.LastSeen = time.Now()
+		}
+	})
+}
+
+// recordInstall returns a step that remembers the version of the APK
+// installed on the device.
+func recordInstall(apk string) *step {
+	return &step{
+		Run: func(ctx context.Context, j *job) error {
+			info, err := readAPKInfo(apk)
+			if err != nil {
+				j.log(levelWarn, "", err.Error(), nil)
+				return nil
+			}
+			serial := defaultSerial(j.serial())
+			updateInventory(func(inv *inventory) {
+				if device := inv.find(serial); device != nil {
+					if device.Installed == nil {
+						device.Installed = map[string]string{}
+					}
+					device.Installed[info.Package] = info.Version()
+				}
+			})
+			return nil
+		},
+	}
+}
+
+func recordUninstall(pkg string) *step {
+	return &step{
+		Run: func(ctx context.Context, j *job) error {
+			serial := defaultSerial(j.serial())
+			updateInventory(func(inv *inventory) {
+				if device := inv.find(serial); device != nil {
+					delete(device.Installed, pkg)
+				}
+			})
+			return nil
+		},
+	}
+}
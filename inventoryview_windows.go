@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+// inventoryRow is a row in the inventory view.
+type inventoryRow struct {
+	Nickname       string
+	Serial         string
+	Address        string
+	Site           string
+	Tags           string
+	Model          string
+	AndroidVersion string
+	LastSeen       string
+	Installed      string
+
+	device *inventoryDevice
+}
+
+func newInventoryRow(d *inventoryDevice) *inventoryRow {
+	var installed []string
+	for pkg, version := range d.Installed {
+		installed = append(installed, pkg+" "+version)
+	}
+	sort.Strings(installed)
+	return &inventoryRow{
+		Nickname:       d.Nickname,
+		Serial:         d.Serial,
+		Address:        d.Address,
+		Site:           d.Site,
+		Tags:           strings.Join(d.Tags, ", "),
+		Model:          d.Model,
+		AndroidVersion: d.AndroidVersion,
+		LastSeen:       d.LastSeen.Format("2006-01-02 15:04"),
+		Installed:      strings.Join(installed, "; "),
+		device:         d,
+	}
+}
+
+// inventoryAddresses returns the text for the address box of the devices
+// that have been connected over the network before.
+func inventoryAddresses() (model []string) {
+	for _, d := range loadInventory().Devices {
+		if d.Address == "" {
+			continue
+		}
+		text := d.Address
+		if d.Nickname != "" {
+			text += " " + d.Nickname
+		} else if d.Model != "" {
+			text += " " + d.Model
+		}
+		model = append(model, text)
+	}
+	return
+}
+
+func showInventory() {
+	var dlg *walk.Dialog
+	var search, nickname, site, tags *walk.LineEdit
+	var table *walk.TableView
+	var saveButton, useButton, deleteButton *walk.PushButton
+	var rows []*inventoryRow
+	selected := func() *inventoryRow {
+		i := table.CurrentIndex()
+		if i < 0 || i >= len(rows) {
+			return nil
+		}
+		return rows[i]
+	}
+	showSelected := func() {
+		row := selected()
+		saveButton.SetEnabled(row != nil)
+		useButton.SetEnabled(row != nil)
+		deleteButton.SetEnabled(row != nil)
+		if row == nil {
+			nickname.SetText("")
+			site.SetText("")
+			tags.SetText("")
+			return
+		}
+		nickname.SetText(row.Nickname)
+		site.SetText(row.Site)
+		tags.SetText(row.Tags)
+	}
+	refresh := func() {
+		serial := ""
+		if row := selected(); row != nil {
+			serial = row.Serial
+		}
+		rows = nil
+		index := -1
+		for _, d := range loadInventory().search(search.Text()) {
+			if d.Serial == serial {
+				index = len(rows)
+			}
+			rows = append(rows, newInventoryRow(d))
+		}
+		table.SetModel(rows)
+		table.SetCurrentIndex(index)
+		showSelected()
+	}
+	showError := func(err error) {
+		if err != nil {
+			walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+		}
+	}
+	Dialog{
+		AssignTo: &dlg,
+		Layout:   VBox{},
+		Title:    "Devices",
+		MinSize:  Size{760, 420},
+		Children: []Widget{
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "Search:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					LineEdit{
+						AssignTo:      &search,
+						StretchFactor: 5,
+						ToolTipText:   "Search by nickname, serial, address, site, tag or model",
+						OnTextChanged: func() { refresh() },
+					},
+				},
+			},
+			TableView{
+				AssignTo: &table,
+				Columns: []TableViewColumn{
+					{Title: "Nickname", DataMember: "Nickname", Width: 90},
+					{Title: "Serial", DataMember: "Serial", Width: 110},
+					{Title: "Address", DataMember: "Address", Width: 120},
+					{Title: "Site", DataMember: "Site", Width: 70},
+					{Title: "Tags", DataMember: "Tags", Width: 80},
+					{Title: "Model", DataMember: "Model", Width: 90},
+					{Title: "Android", DataMember: "AndroidVersion", Width: 55},
+					{Title: "Last Seen", DataMember: "LastSeen", Width: 100},
+					{Title: "Installed", DataMember: "Installed", Width: 200},
+				},
+				OnCurrentIndexChanged: func() { showSelected() },
+			},
+			Composite{
+				Layout: Grid{Columns: 6, MarginsZero: true},
+				Children: []Widget{
+					TextLabel{Text: "Nickname:", TextAlignment: AlignHNearVCenter},
+					LineEdit{AssignTo: &nickname},
+					TextLabel{Text: "Site:", TextAlignment: AlignHNearVCenter},
+					LineEdit{AssignTo: &site},
+					TextLabel{Text: "Tags:", TextAlignment: AlignHNearVCenter},
+					LineEdit{AssignTo: &tags, ToolTipText: "Separated by commas"},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					PushButton{
+						AssignTo: &saveButton,
+						Text:     "SAVE",
+						OnClicked: func() {
+							row := selected()
+							if row == nil {
+								return
+							}
+							var tagList []string
+							for _, t := range strings.Split(tags.Text(), ",") {
+								if t = strings.TrimSpace(t); t != "" {
+									tagList = append(tagList, t)
+								}
+							}
+							showError(updateInventory(func(inv *inventory) {
+								if d := inv.find(row.Serial); d != nil {
+									d.Nickname = strings.TrimSpace(nickname.Text())
+									d.Site = strings.TrimSpace(site.Text())
+									d.Tags = tagList
+								}
+							}))
+							refresh()
+							adbAddress.SetModel(inventoryAddresses())
+						},
+					},
+					PushButton{
+						AssignTo: &useButton,
+						Text:     "USE",
+						OnClicked: func() {
+							if row := selected(); row != nil {
+								adbAddress.SetText(row.device.Target())
+								dlg.Accept()
+							}
+						},
+					},
+					PushButton{
+						AssignTo: &deleteButton,
+						Text:     "DELETE",
+						OnClicked: func() {
+							row := selected()
+							if row == nil {
+								return
+							}
+							ret := walk.MsgBox(dlg, "Delete",
+								fmt.Sprintf("Are you sure you want to remove %s from the inventory?", row.Serial),
+								walk.MsgBoxYesNo|walk.MsgBoxIconExclamation|walk.MsgBoxDefButton2,
+							)
+							if ret != walk.DlgCmdYes {
+								return
+							}
+							showError(updateInventory(func(inv *inventory) {
+								for i, d := range inv.Devices {
+									if d.Serial == row.Serial {
+										inv.Devices = append(inv.Devices[:i], inv.Devices[i+1:]...)
+										break
+									}
+								}
+							}))
+							refresh()
+						},
+					},
+					TextLabel{
+						StretchFactor: 2,
+						Text:          `Type "tag:<tag>" or "site:<site>" in the address box to operate on a set of devices.`,
+						TextAlignment: AlignHFarVCenter,
+					},
+				},
+			},
+		},
+	}.Create(md)
+	updateDialog(dlg)
+	refresh()
+	dlg.Run()
+}
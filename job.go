@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// commandError is the error of a command that exited with a non-zero code.
+type commandError struct {
+	Command  string
+	ExitCode int
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.Command, e.ExitCode)
+}
+
+// stepError is the error of the step a job failed at.
+type stepError struct {
+	Step     string
+	Attempts int
+	Err      error
+}
+
+func (e *stepError) Error() string {
+	return e.Step + ": " + e.Err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.Err
+}
+
+// step is a named part of a job. Run is given Timeout to finish and is tried
+// again up to Retries times, RetryDelay apart, if it fails. Size is the
+// number of bytes the step sends to the device, if known. Audit is what the
+// step puts on or removes from the device, for the audit log.
+type step struct {
+	Name       string
+	Timeout    time.Duration
+	Retries    int
+	RetryDelay time.Duration
+	Size       int64
+	Audit      *auditItem
+	Run        func(ctx context.Context, j *job) error
+}
+
+// stepStatus is the progress of a step.
+type stepStatus struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"` // pending, running, done, failed, cancelled or skipped
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Sent     int64     `json:"sent"`
+	Size     int64     `json:"size"`
+}
+
+// Elapsed returns how long the step has been running or took.
+func (s stepStatus) Elapsed() time.Duration {
+	switch {
+	case s.Started.IsZero():
+		return 0
+	case s.Finished.IsZero():
+		return time.Since(s.Started)
+	default:
+		return s.Finished.Sub(s.Started)
+	}
+}
+
+// job runs its steps on a device one after another, until one of them fails
+// or the job is cancelled. Serial is what adb addresses the device by, which
+// is the address a network device is connected at once it is. Operator is
+// who the audit log says ran the job. bootloader is the serial of the device
+// in fastboot, once a step has read it.
+type job struct {
+	operation
+	ID       string
+	Steps    []*step
+	Serial   string
+	Operator string
+
+	mutex      sync.Mutex
+	cancel     context.CancelFunc
+	stopped    bool
+	finished   bool
+	err        error
+	status     []stepStatus
+	current    int
+	listeners  []func(*job)
+	bootloader string
+}
+
+var lastJobID int64
+
+func newJob(name, device string, steps ...*step) *job {
+	j := &job{
+		operation: operation{Name: name, Device: device},
+		ID:        strconv.FormatInt(atomic.AddInt64(&lastJobID, 1), 10),
+		Serial:    device,
+		Operator:  operator,
+	}
+	return j.add(steps...)
+}
+
+func (j *job) add(steps ...*step) *job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Steps = append(j.Steps, steps...)
+	for _, s := range steps {
+		j.status = append(j.status, stepStatus{Name: s.Name, State: "pending", Size: s.Size})
+	}
+	return j
+}
+
+// subscribe calls f whenever the progress of the job changes.
+func (j *job) subscribe(f func(*job)) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.listeners = append(j.listeners, f)
+}
+
+// progress returns the status of every step.
+func (j *job) progress() []stepStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return append([]stepStatus{}, j.status...)
+}
+
+func (j *job) update(f func(s *stepStatus)) {
+	j.mutex.Lock()
+	f(&j.status[j.current])
+	listeners := append([]func(*job){}, j.listeners...)
+	j.mutex.Unlock()
+	for _, l := range listeners {
+		l(j)
+	}
+}
+
+// addSent adds to the bytes the current step has sent.
+func (j *job) addSent(n int64) {
+	j.update(func(s *stepStatus) {
+		s.Sent += n
+		if s.Size > 0 && s.Sent > s.Size {
+			s.Sent = s.Size
+		}
+	})
+}
+
+// run runs the steps and returns a *stepError if one of them fails.
+func (j *job) run(ctx context.Context) (err error) {
+	defer func() {
+		j.mutex.Lock()
+		j.finished = true
+		j.err = err
+		j.mutex.Unlock()
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	j.mutex.Lock()
+	j.cancel = cancel
+	stopped := j.stopped
+	j.mutex.Unlock()
+	if stopped {
+		j.skip()
+		return &stepError{Err: context.Canceled}
+	}
+	start := time.Now()
+	for i, s := range j.Steps {
+		j.mutex.Lock()
+		j.current = i
+		j.mutex.Unlock()
+		j.update(func(status *stepStatus) {
+			status.State = "running"
+			status.Started = time.Now()
+		})
+		err := j.runStep(ctx, s)
+		j.update(func(status *stepStatus) {
+			status.Finished = time.Now()
+			switch {
+			case err == nil:
+				status.State = "done"
+				if status.Size > 0 {
+					status.Sent = status.Size
+				}
+			case ctx.Err() != nil:
+				status.State = "cancelled"
+			default:
+				status.State = "failed"
+			}
+		})
+		if err != nil {
+			j.skip()
+			return err
+		}
+	}
+	j.log(levelDebug, "", "finished in "+time.Since(start).Round(time.Millisecond).String(), nil)
+	return nil
+}
+
+func (j *job) runStep(ctx context.Context, s *step) error {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		sctx, cancel := ctx, context.CancelFunc(func() {})
+		if s.Timeout > 0 {
+			sctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		}
+		err := s.Run(sctx, j)
+		timedOut := sctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			if s.Name != "" {
+				j.log(levelDebug, s.Name, "done in "+time.Since(start).Round(time.Millisecond).String(), nil)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			j.log(levelWarn, s.Name, "cancelled", nil)
+			return &stepError{Step: s.Name, Attempts: attempt, Err: ctx.Err()}
+		}
+		if timedOut {
+			err = fmt.Errorf("timed out after %s: %w", s.Timeout, context.DeadlineExceeded)
+		}
+		if attempt > s.Retries {
+			var exitCode *int
+			var cmdErr *commandError
+			if errors.As(err, &cmdErr) {
+				exitCode = &cmdErr.ExitCode
+			}
+			j.log(levelError, s.Name, err.Error(), exitCode)
+			return &stepError{Step: s.Name, Attempts: attempt, Err: err}
+		}
+		j.log(levelWarn, s.Name, fmt.Sprintf("%s, retrying (%d/%d)", err, attempt, s.Retries), nil)
+		select {
+		case <-ctx.Done():
+			j.log(levelWarn, s.Name, "cancelled", nil)
+			return &stepError{Step: s.Name, Attempts: attempt, Err: ctx.Err()}
+		case <-time.After(s.RetryDelay):
+		}
+	}
+}
+
+// state returns whether the job is queued, running, done, failed or
+// cancelled, and the error it failed with.
+func (j *job) state() (string, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	state := "queued"
+	for _, s := range j.status {
+		switch s.State {
+		case "running":
+			return "running", nil
+		case "failed", "cancelled":
+			return s.State, j.err
+		case "done":
+			state = "done"
+		case "pending":
+			if state == "done" {
+				return "running", nil
+			}
+		case "skipped":
+			if state == "queued" {
+				state = "cancelled" // before it started
+			}
+		}
+	}
+	if state == "queued" && j.finished {
+		state = "done" // nothing to do
+	}
+	return state, j.err
+}
+
+// skip marks the steps that have not run as skipped.
+func (j *job) skip() {
+	j.mutex.Lock()
+	for i := range j.status {
+		if j.status[i].State == "pending" {
+			j.status[i].State = "skipped"
+		}
+	}
+	listeners := append([]func(*job){}, j.listeners...)
+	j.mutex.Unlock()
+	for _, l := range listeners {
+		l(j)
+	}
+}
+
+// stop cancels the job, or keeps it from running if it has not started.
+func (j *job) stop() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.stopped = true
+	if j.cancel != nil {
+		j.cancel()
+	}
+}
+
+// serial returns what adb addresses the device of the job by.
+func (j *job) serial() string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.Serial
+}
+
+// serialArgs returns the arguments of adb or scrcpy to address the device,
+// none for the default device.
+func (j *job) serialArgs() []string {
+	if serial := j.serial(); serial != "" {
+		return []string{"-s", serial}
+	}
+	return nil
+}
+
+// fastbootArgs returns the arguments of fastboot to address the device of
+// the job. Without them fastboot picks any device in the bootloader, which
+// may be another job's.
+func (j *job) fastbootArgs() []string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.bootloader != "" {
+		return []string{"-s", j.bootloader}
+	}
+	return nil
+}
+
+// commandStep returns a step running a program, named after it.
+func commandStep(exe string, args ...string) *step {
+	return &step{
+		Name: stepName(exe, args),
+		Run: func(ctx context.Context, j *job) error {
+			_, err := j.command(ctx, nil, exe, args...)
+			return err
+		},
+	}
+}
+
+var (
+	// Sending 'boot' (12345 KB)    OKAY [  0.450s]
+	// Sending sparse 'system' 2/4 (511984 KB)    OKAY [ 15.312s]
+	fastbootSending = regexp.MustCompile(`(?i)sending (?:sparse )?'[^']+'(?: \d+/\d+)? \((\d+) KB\)`)
+)
+
+// fastbootStep returns a step running fastboot that keeps track of the
+// bytes sent by the size of the image, or of the chunks of a sparse image.
+func fastbootStep(fastboot, image string, args ...string) *step {
+	s := commandStep(fastboot, args...)
+	if fi, err := os.Stat(image); err == nil {
+		s.Size = fi.Size()
+	}
+	s.Run = func(ctx context.Context, j *job) error {
+		if len(j.fastbootArgs()) == 0 {
+			return errors.New("the serial of the device is not known")
+		}
+		var sending int64
+		_, err := j.command(ctx, func(line string) {
+			if m := fastbootSending.FindStringSubmatch(line); m != nil {
+				kb, _ := strconv.ParseInt(m[1], 10, 64)
+				sending = kb << 10
+			}
+			// older versions print OKAY on a line of its own
+			if sending > 0 && strings.Contains(line, "OKAY") {
+				j.addSent(sending)
+				sending = 0
+			}
+		}, fastboot, append(j.fastbootArgs(), args...)...)
+		return err
+	}
+	return s
+}
+
+// fastbootDeviceStep returns a step running fastboot on the device of the
+// job, like deviceStep does adb.
+func fastbootDeviceStep(fastboot string, args ...string) *step {
+	s := commandStep(fastboot, args...)
+	s.Run = func(ctx context.Context, j *job) error {
+		if len(j.fastbootArgs()) == 0 {
+			return errors.New("the serial of the device is not known")
+		}
+		_, err := j.command(ctx, nil, fastboot, append(j.fastbootArgs(), args...)...)
+		return err
+	}
+	return s
+}
+
+// bootloaderSerialStep returns a step reading the serial the device will
+// have in the bootloader, which is not the address adb has for a network
+// device, falling back to the one in the inventory.
+func bootloaderSerialStep() *step {
+	return &step{
+		Name:    "read serial",
+		Timeout: 30 * time.Second,
+		Run: func(ctx context.Context, j *job) error {
+			serial := j.adbOutput(ctx, "shell", "getprop", "ro.serialno")
+			if serial == "" {
+				if d := loadInventory().find(j.serial()); d != nil {
+					serial = d.Serial
+				}
+			}
+			if serial == "" {
+				return errors.New("can't read the serial of the device")
+			}
+			j.mutex.Lock()
+			j.bootloader = serial
+			j.mutex.Unlock()
+			return nil
+		},
+	}
+}
+
+// eta estimates the time left for the steps with a size from the
+// throughput so far. It is false until there is enough to go by.
+func eta(status []stepStatus) (time.Duration, bool) {
+	var sent, total int64
+	var elapsed time.Duration
+	for _, s := range status {
+		total += s.Size
+		if s.Size > 0 && (s.State == "done" || s.State == "running") {
+			sent += s.Sent
+			elapsed += s.Elapsed()
+		}
+	}
+	if sent == 0 || elapsed < time.Second {
+		return 0, false
+	}
+	rate := float64(sent) / elapsed.Seconds()
+	return time.Duration(float64(total-sent) / rate * float64(time.Second)), true
+}
+
+// adbStep returns a step running adb on the device of the job.
+func adbStep(args ...string) *step {
+	return deviceStep(libAdbExe, args...)
+}
+
+// deviceStep returns a step running a program taking -s, like adb or
+// scrcpy, on the device of the job.
+func deviceStep(exe string, args ...string) *step {
+	s := commandStep(exe, args...)
+	s.Run = func(ctx context.Context, j *job) error {
+		_, err := j.command(ctx, nil, exe, append(j.serialArgs(), args...)...)
+		return err
+	}
+	return s
+}
+
+// messageStep returns a step logging a message.
+func messageStep(v ...interface{}) *step {
+	message := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	return &step{
+		Run: func(ctx context.Context, j *job) error {
+			j.log(levelInfo, "", message, nil)
+			return nil
+		},
+	}
+}
+
+// connectStep returns a step connecting to a network device unless it is
+// connected already, at the address it was last paired at if it has moved.
+// adb connect exits with 0 even if it fails, so its output is checked.
+func connectStep(addr string) *step {
+	return &step{
+		Name:       "connect",
+		Timeout:    30 * time.Second,
+		Retries:    2,
+		RetryDelay: 2 * time.Second,
+		Run: func(ctx context.Context, j *job) error {
+			if d, ok := monitor.get(addr); ok && d.State == "device" {
+				return nil
+			}
+			paired := pairedAddress(addr)
+			out, err := j.command(ctx, nil, libAdbExe, "connect", paired)
+			if err != nil {
+				return err
+			}
+			if strings.Contains(out, "failed to") || strings.Contains(out, "cannot") {
+				return fmt.Errorf("failed to connect to %s", paired)
+			}
+			j.mutex.Lock()
+			j.Serial = paired
+			j.mutex.Unlock()
+			return nil
+		},
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFilePrefix = "session-"
+	logFileExt    = ".jsonl"
+)
+
+// sessionLog writes the events of this session to JSON Lines files in
+// logDir, starting a new file whenever the current one grows larger than
+// maxSize. The retention limits are applied again whenever it does, for a
+// daemon that runs for weeks.
+type sessionLog struct {
+	mutex    sync.Mutex
+	name     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxAge   time.Duration
+	maxTotal int64
+	paths    []string
+}
+
+var session *sessionLog
+
+// logDir returns the directory of the log files, which follows the XDG base
+// directory specification outside of Windows.
+func logDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(dataDir, "logs")
+	}
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "adbinstall", "logs")
+}
+
+// startSessionLog removes the log files past the retention limits and
+// starts writing the events to a new log file.
+func startSessionLog() {
+	c := loadConfig()
+	if err := os.MkdirAll(logDir(), 0755); err != nil {
+		log.Println(err)
+		return
+	}
+	session = &sessionLog{
+		name:     logFilePrefix + time.Now().Format("20060102-150405"),
+		maxSize:  int64(c.LogFileMB) << 20,
+		maxAge:   time.Duration(c.LogRetentionDays) * 24 * time.Hour,
+		maxTotal: int64(c.LogRetentionMB) << 20,
+	}
+	removeOldLogs(session.maxAge, session.maxTotal)
+	for _, e := range events.list() {
+		session.write(e)
+	}
+	events.subscribe(session.write)
+}
+
+func (s *sessionLog) write(e logEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rotated := false
+	if s.file != nil && s.size+int64(len(b)) > s.maxSize {
+		s.file.Close()
+		s.file = nil
+		rotated = true
+	}
+	if s.file == nil {
+		name := s.name
+		if len(s.paths) > 0 {
+			name += fmt.Sprintf("-%d", len(s.paths)+1)
+		}
+		path := filepath.Join(logDir(), name+logFileExt)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		s.file, s.size = f, 0
+		s.paths = append(s.paths, path)
+		if rotated {
+			removeOldLogs(s.maxAge, s.maxTotal)
+		}
+	}
+	n, _ := s.file.Write(b)
+	s.size += int64(n)
+}
+
+func (s *sessionLog) close() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// save writes all files of this session to w.
+func (s *sessionLog) save(w io.Writer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file != nil {
+		s.file.Sync()
+	}
+	for _, path := range s.paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue // removed by the retention limits
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOldLogs deletes the log files older than maxAge, and then the oldest
+// files until all of them take up no more than maxTotal bytes. Zero means
+// no limit.
+func removeOldLogs(maxAge time.Duration, maxTotal int64) {
+	files, err := ioutil.ReadDir(logDir())
+	if err != nil {
+		return
+	}
+	var logs []os.FileInfo
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), logFilePrefix) && strings.HasSuffix(f.Name(), logFileExt) {
+			logs = append(logs, f)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].ModTime().After(logs[j].ModTime())
+	})
+	var total int64
+	for _, f := range logs {
+		total += f.Size()
+		tooOld := maxAge > 0 && time.Since(f.ModTime()) > maxAge
+		tooLarge := maxTotal > 0 && total > maxTotal
+		if tooOld || tooLarge {
+			os.Remove(filepath.Join(logDir(), f.Name()))
+		}
+	}
+}
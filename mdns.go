@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Android 11+ advertises wireless debugging with these mDNS services, older
+// devices with adb over TCP enabled may advertise _adb._tcp.
+const (
+	mdnsADB        = "_adb._tcp.local."
+	mdnsADBConnect = "_adb-tls-connect._tcp.local."
+	mdnsADBPairing = "_adb-tls-pairing._tcp.local."
+)
+
+var (
+	mdnsIPv4Addr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsIPv6Addr = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// mdnsService is a service instance found by browseMDNS.
+type mdnsService struct {
+	Instance string
+	Service  string
+	Host     string
+	Port     uint16
+	IPs      []net.IPAddr
+}
+
+// Name returns the instance name without the service type, for example
+// "adb-0A1B2C3D-xYz12a".
+func (s *mdnsService) Name() string {
+	return strings.TrimSuffix(strings.TrimSuffix(s.Instance, s.Service), ".")
+}
+
+// Addresses returns the host:port addresses of the service, IPv4 addresses
+// first.
+func (s *mdnsService) Addresses() (addrs []string) {
+	port := strconv.Itoa(int(s.Port))
+	for _, v4 := range []bool{true, false} {
+		for _, ip := range s.IPs {
+			if (ip.IP.To4() != nil) == v4 {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+	return
+}
+
+// browseMDNS sends mDNS queries for the ADB services over IPv4 and IPv6 on
+// every multicast capable interface and collects the answers until ctx is
+// done.
+func browseMDNS(ctx context.Context, services ...string) ([]*mdnsService, error) {
+	if len(services) == 0 {
+		services = []string{mdnsADB, mdnsADBConnect, mdnsADBPairing}
+	}
+	query, err := mdnsQuery(services)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+	pc.SetMulticastTTL(255)
+	conns := []*net.UDPConn{conn}
+	// not every computer has IPv6
+	var pc6 *ipv6.PacketConn
+	if conn6, err := net.ListenUDP("udp6", &net.UDPAddr{}); err == nil {
+		defer conn6.Close()
+		pc6 = ipv6.NewPacketConn(conn6)
+		pc6.SetMulticastHopLimit(255)
+		conns = append(conns, conn6)
+	}
+	send := func() {
+		ifaces, _ := net.Interfaces()
+		for i := range ifaces {
+			iface := &ifaces[i]
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			if pc.SetMulticastInterface(iface) == nil {
+				pc.WriteTo(query, nil, mdnsIPv4Addr)
+			}
+			if pc6 != nil && pc6.SetMulticastInterface(iface) == nil {
+				pc6.WriteTo(query, nil, mdnsIPv6Addr)
+			}
+		}
+	}
+	go func() {
+		// queries may get lost, ask again a few times
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			send()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		for _, c := range conns {
+			c.SetReadDeadline(time.Now())
+		}
+	}()
+	r := newMDNSResolver(services)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *net.UDPConn) {
+			defer wg.Done()
+			buf := make([]byte, 9000)
+			for {
+				n, src, err := c.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				r.parse(buf[:n], src)
+			}
+		}(c)
+	}
+	wg.Wait()
+	return r.services(), nil
+}
+
+// discoverMDNSDevices browses for ADB services for a few seconds and returns
+// an entry for every address they are reachable at.
+func discoverMDNSDevices(ctx context.Context) (out []*adbDevice) {
+	bctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	services, err := browseMDNS(bctx)
+	cancel()
+	if err != nil {
+		log.Println("mdns:", err)
+		return
+	}
+	key := loadADBKey()
+	for _, s := range services {
+		for _, addr := range s.Addresses() {
+			d := &adbDevice{
+				Address: addr,
+				Name:    s.Name(),
+			}
+			switch s.Service {
+			case mdnsADBConnect:
+				d.State = "tls"
+			case mdnsADBPairing:
+				d.State = "pairing"
+			default:
+				// plain adb over tcp, the handshake tells us more
+				pctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+				if probed, err := probeADB(pctx, d.Address, key); err == nil {
+					probed.Name = d.Name
+					d = probed
+				}
+				cancel()
+			}
+			log.Println("found", d)
+			out = append(out, d)
+		}
+	}
+	return
+}
+
+func mdnsQuery(services []string) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		name, err := dnsmessage.NewName(service)
+		if err != nil {
+			return nil, err
+		}
+		err = b.Question(dnsmessage.Question{
+			Name:  name,
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// mdnsResolver joins the PTR, SRV and address records of all answers, as
+// they are often spread over several packets.
+type mdnsResolver struct {
+	mutex     sync.Mutex
+	wanted    map[string]bool
+	instances map[string]string // instance -> service
+	srv       map[string]dnsmessage.SRVResource
+	addrs     map[string][]net.IPAddr
+}
+
+func newMDNSResolver(services []string) *mdnsResolver {
+	r := &mdnsResolver{
+		wanted:    map[string]bool{},
+		instances: map[string]string{},
+		srv:       map[string]dnsmessage.SRVResource{},
+		addrs:     map[string][]net.IPAddr{},
+	}
+	for _, s := range services {
+		r.wanted[strings.ToLower(s)] = true
+	}
+	return r
+}
+
+// parse reads the records of a packet from src. Link-local addresses get the
+// zone of the interface the packet was received on.
+func (r *mdnsResolver) parse(packet []byte, src *net.UDPAddr) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil || !header.Response {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	var resources []dnsmessage.Resource
+	if answers, err := p.AllAnswers(); err == nil {
+		resources = append(resources, answers...)
+	}
+	p.SkipAllAuthorities()
+	if additionals, err := p.AllAdditionals(); err == nil {
+		resources = append(resources, additionals...)
+	}
+	for _, res := range resources {
+		name := strings.ToLower(res.Header.Name.String())
+		switch body := res.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if r.wanted[name] {
+				r.instances[body.PTR.String()] = name
+			}
+		case *dnsmessage.SRVResource:
+			r.srv[name] = *body
+		case *dnsmessage.AResource:
+			r.addIP(name, net.IPAddr{IP: net.IP(body.A[:])})
+		case *dnsmessage.AAAAResource:
+			ip := net.IPAddr{IP: net.IP(body.AAAA[:])}
+			if ip.IP.IsLinkLocalUnicast() {
+				ip.Zone = sourceZone(src)
+			}
+			r.addIP(name, ip)
+		}
+	}
+}
+
+func (r *mdnsResolver) addIP(host string, ip net.IPAddr) {
+	for _, i := range r.addrs[host] {
+		if i.IP.Equal(ip.IP) && i.Zone == ip.Zone {
+			return
+		}
+	}
+	r.addrs[host] = append(r.addrs[host], ip)
+}
+
+func (r *mdnsResolver) services() (out []*mdnsService) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for instance, service := range r.instances {
+		srv, ok := r.srv[strings.ToLower(instance)]
+		if !ok {
+			continue
+		}
+		host := srv.Target.String()
+		out = append(out, &mdnsService{
+			Instance: instance,
+			Service:  service,
+			Host:     host,
+			Port:     srv.Port,
+			IPs:      r.addrs[strings.ToLower(host)],
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Instance < out[j].Instance
+	})
+	return
+}
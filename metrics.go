@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a counter or a histogram in the Prometheus text format, with a
+// series for every combination of the values of its labels.
+type metric struct {
+	name    string
+	help    string
+	kind    string // counter or histogram
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of a counter, or the count, sum and cumulative bucket
+// counts of a histogram.
+type series struct {
+	values  []string
+	count   float64
+	sum     float64
+	buckets []uint64
+}
+
+// the metrics in the order they are written
+var metrics []*metric
+
+var (
+	durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+	jobsTotal = newCounter("adbinstall_jobs_total",
+		"Jobs finished, by operation, device model and result (done, failed or cancelled).",
+		"operation", "model", "result")
+	jobDuration = newHistogram("adbinstall_job_duration_seconds",
+		"Time jobs took from their first step to their last.",
+		durationBuckets, "operation", "model", "result")
+	stepDuration = newHistogram("adbinstall_step_duration_seconds",
+		"Time successful steps took, like flashing a partition.",
+		durationBuckets, "operation", "step", "model")
+	commandFailures = newCounter("adbinstall_command_failures_total",
+		"Commands like adb or fastboot that exited with an error code.",
+		"operation", "command", "model", "code")
+	downloadBytes = newCounter("adbinstall_download_bytes_total",
+		"Bytes of images downloaded.")
+	downloadSpeed = newHistogram("adbinstall_download_speed_bytes_per_second",
+		"Average speed of finished image downloads.",
+		[]float64{128 << 10, 512 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20})
+	scansTotal = newCounter("adbinstall_scans_total",
+		"Network scans for devices.")
+	scanDuration = newHistogram("adbinstall_scan_duration_seconds",
+		"Time network scans took.",
+		[]float64{1, 2, 5, 10, 30, 60, 120, 300})
+	scanResults = newCounter("adbinstall_scan_devices_total",
+		"Devices found by network scans, by state (device, unauthorized, tls or pairing).",
+		"state")
+)
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, nil, labels)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return newMetric("histogram", name, help, buckets, labels)
+}
+
+func newMetric(kind, name, help string, buckets []float64, labels []string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+// get returns the series with the values of the labels, in their order.
+func (m *metric) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{
+			values:  values,
+			buckets: make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to a counter.
+func (m *metric) add(v float64, values ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.get(values).count += v
+}
+
+// inc adds one to a counter.
+func (m *metric) inc(values ...string) {
+	m.add(1, values...)
+}
+
+// observe adds v to a histogram.
+func (m *metric) observe(v float64, values ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.get(values)
+	s.count++
+	s.sum += v
+	for i, le := range m.buckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelText formats the labels of a series like {operation="flash"}, with
+// extra appended, like le="+Inf".
+func (m *metric) labelText(s *series, extra ...string) string {
+	var pairs []string
+	for i, name := range m.labels {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(s.values[i])+`"`)
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	var keys []string
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelText(s), formatFloat(s.count))
+			continue
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelText(s, `le="`+formatFloat(le)+`"`), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, m.labelText(s, `le="+Inf"`), formatFloat(s.count))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelText(s), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.name, m.labelText(s), formatFloat(s.count))
+	}
+}
+
+// serveMetrics writes every metric in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// deviceModel returns the model of a device for the labels of its metrics,
+// from the adb server or else the inventory, as the device may be gone by
+// the time a job finishes.
+func deviceModel(serial string) string {
+	if d, ok := monitor.get(serial); ok && d.Model != "" {
+		return d.Model
+	}
+	if d := loadInventory().find(serial); d != nil && d.Model != "" {
+		return d.Model
+	}
+	return "unknown"
+}
+
+// observeJob counts a finished job and the time it and its successful steps
+// took. A job cancelled before it started only counts.
+func observeJob(j *job) {
+	state, _ := j.state()
+	model := deviceModel(j.serial())
+	jobsTotal.inc(j.Name, model, state)
+	var started, finished time.Time
+	for _, s := range j.progress() {
+		if s.Started.IsZero() {
+			continue
+		}
+		if started.IsZero() {
+			started = s.Started
+		}
+		finished = s.Finished
+		if s.State == "done" && s.Name != "" {
+			stepDuration.observe(s.Elapsed().Seconds(), j.Name, s.Name, model)
+		}
+	}
+	if !started.IsZero() && !finished.IsZero() {
+		jobDuration.observe(finished.Sub(started).Seconds(), j.Name, model, state)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adbServerAddress = "127.0.0.1:5037"
+)
+
+// deviceState is a device as seen by the adb server, or by fastboot when
+// the device is in the bootloader.
+type deviceState struct {
+	Serial      string
+	State       string // device, offline, unauthorized, bootloader, recovery, sideload...
+	Product     string
+	Model       string
+	Device      string
+	TransportID string
+	Seen        time.Time
+}
+
+type deviceEvent struct {
+	Kind     string // added, changed or removed
+	Device   deviceState
+	Previous deviceState
+}
+
+// deviceMonitor keeps track of the connected devices by following
+// host:track-devices of the adb server and polling fastboot, and notifies
+// its listeners of every change.
+type deviceMonitor struct {
+	mutex     sync.Mutex
+	adb       map[string]deviceState
+	fastboot  map[string]deviceState
+	devices   map[string]deviceState
+	listeners []func(deviceEvent)
+}
+
+var monitor = &deviceMonitor{
+	adb:      map[string]deviceState{},
+	fastboot: map[string]deviceState{},
+	devices:  map[string]deviceState{},
+}
+
+func (m *deviceMonitor) subscribe(f func(deviceEvent)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners = append(m.listeners, f)
+}
+
+// list returns the devices sorted by serial.
+func (m *deviceMonitor) list() (devices []deviceState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, d := range m.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Serial < devices[j].Serial
+	})
+	return
+}
+
+func (m *deviceMonitor) get(serial string) (deviceState, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	d, ok := m.devices[serial]
+	return d, ok
+}
+
+func (m *deviceMonitor) run(ctx context.Context) {
+	go m.pollFastboot(ctx)
+	for ctx.Err() == nil {
+		err := m.trackADB(ctx)
+		m.update(func() { m.adb = map[string]deviceState{} })
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("device monitor:", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func (m *deviceMonitor) trackADB(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", adbServerAddress)
+	if err != nil {
+		// start the server, it is killed on exit if nobody else started it
+		if existingAdbPid == -1 {
+			existingAdbPid = findADBProcess()
+		}
+		if _, err := toolOutput(ctx, libAdbExe, "start-server"); err != nil {
+			return err
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", adbServerAddress)
+		if err != nil {
+			return err
+		}
+	}
+	defer conn.Close()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	r := bufio.NewReader(conn)
+	if err := adbServerRequest(conn, r, "host:track-devices-l"); err != nil {
+		return err
+	}
+	for {
+		payload, err := readADBServerData(r)
+		if err != nil {
+			return err
+		}
+		devices := map[string]deviceState{}
+		for _, line := range strings.Split(payload, "\n") {
+			if d, ok := parseDeviceLine(line); ok {
+				devices[d.Serial] = d
+			}
+		}
+		m.update(func() { m.adb = devices })
+	}
+}
+
+// adbServerRequest sends a request to the adb server, see
+// https://android.googlesource.com/platform/packages/modules/adb/+/HEAD/OVERVIEW.TXT
+func adbServerRequest(w io.Writer, r *bufio.Reader, request string) error {
+	if _, err := fmt.Fprintf(w, "%04x%s", len(request), request); err != nil {
+		return err
+	}
+	status := make([]byte, 4)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return err
+	}
+	if string(status) == "OKAY" {
+		return nil
+	}
+	msg, err := readADBServerData(r)
+	if err != nil {
+		return fmt.Errorf("adb server: %s", status)
+	}
+	return fmt.Errorf("adb server: %s", msg)
+}
+
+func readADBServerData(r *bufio.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(header), 16, 32)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// parseDeviceLine parses a line of adb devices -l, like
+// "192.168.1.5:5555 device product:flame model:Pixel_4 device:flame transport_id:3".
+func parseDeviceLine(line string) (d deviceState, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return
+	}
+	d.Serial, d.State = fields[0], fields[1]
+	for _, f := range fields[2:] {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "product":
+			d.Product = kv[1]
+		case "model":
+			d.Model = strings.Replace(kv[1], "_", " ", -1)
+		case "device":
+			d.Device = kv[1]
+		case "transport_id":
+			d.TransportID = kv[1]
+		}
+	}
+	d.Seen = time.Now()
+	return d, true
+}
+
+// pollFastboot lists the devices in the bootloader, which the adb server
+// doesn't know about.
+func (m *deviceMonitor) pollFastboot(ctx context.Context) {
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for {
+		fastboot := imageTool(currentImageDir(), "fastboot")
+		if _, err := exec.LookPath(fastboot); err == nil {
+			out, _ := toolOutput(ctx, fastboot, "devices")
+			devices := map[string]deviceState{}
+			for _, line := range strings.Split(string(out), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 && fields[1] == "fastboot" {
+					devices[fields[0]] = deviceState{Serial: fields[0], State: "bootloader", Seen: time.Now()}
+				}
+			}
+			m.update(func() { m.fastboot = devices })
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// update applies f and notifies the listeners of the differences.
+func (m *deviceMonitor) update(f func()) {
+	m.mutex.Lock()
+	f()
+	devices := map[string]deviceState{}
+	for serial, d := range m.adb {
+		devices[serial] = d
+	}
+	for serial, d := range m.fastboot {
+		devices[serial] = d
+	}
+	var events []deviceEvent
+	for serial, d := range devices {
+		prev, ok := m.devices[serial]
+		if !ok {
+			events = append(events, deviceEvent{Kind: "added", Device: d})
+		} else if prev.State != d.State || prev.Model != d.Model {
+			events = append(events, deviceEvent{Kind: "changed", Device: d, Previous: prev})
+		}
+	}
+	for serial, d := range m.devices {
+		if _, ok := devices[serial]; !ok {
+			events = append(events, deviceEvent{Kind: "removed", Device: d, Previous: d})
+		}
+	}
+	m.devices = devices
+	listeners := append([]func(deviceEvent){}, m.listeners...)
+	m.mutex.Unlock()
+	for _, e := range events {
+		for _, l := range listeners {
+			l(e)
+		}
+	}
+}
+
+func logDeviceEvent(e deviceEvent) {
+	switch e.Kind {
+	case "added":
+		log.Println(e.Device.Serial, "is", e.Device.State)
+	case "changed":
+		log.Println(e.Device.Serial, "changed from", e.Previous.State, "to", e.Device.State)
+	case "removed":
+		log.Println(e.Device.Serial, "is gone")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+)
+
+var (
+	deviceTableModel []*deviceState
+)
+
+func updateDeviceTable() {
+	current := ""
+	if i := deviceTable.CurrentIndex(); i > -1 && i < len(deviceTableModel) {
+		current = deviceTableModel[i].Serial
+	}
+	deviceTableModel = nil
+	index := -1
+	for _, d := range monitor.list() {
+		d := d
+		if d.Serial == current {
+			index = len(deviceTableModel)
+		}
+		deviceTableModel = append(deviceTableModel, &d)
+	}
+	deviceTable.SetModel(deviceTableModel)
+	deviceTable.SetCurrentIndex(index)
+}
+
+// useSelectedDevice puts the address of the selected network device into
+// the address box.
+func useSelectedDevice() {
+	i := deviceTable.CurrentIndex()
+	if i < 0 || i >= len(deviceTableModel) {
+		return
+	}
+	serial := deviceTableModel[i].Serial
+	if _, _, err := net.SplitHostPort(serial); err == nil {
+		adbAddress.SetText(serial)
+	}
+}
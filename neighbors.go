@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// numericZone returns the interface index for the zone of a link-local
+// address, adb on Windows doesn't understand interface names.
+func numericZone(zone string) string {
+	if zone == "" {
+		return ""
+	}
+	if _, err := strconv.Atoi(zone); err == nil {
+		return zone
+	}
+	if iface, err := net.InterfaceByName(zone); err == nil {
+		return strconv.Itoa(iface.Index)
+	}
+	return zone
+}
+
+// sourceZone returns the zone of the interface a packet from src was
+// received on, so that link-local addresses it announces can be reached.
+func sourceZone(src *net.UDPAddr) string {
+	if src.Zone != "" {
+		return numericZone(src.Zone)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(src.IP) {
+				return strconv.Itoa(iface.Index)
+			}
+		}
+	}
+	return ""
+}
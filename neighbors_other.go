@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// getIPv6Neighbors returns the IPv6 addresses in the neighbour table of
+// ip -6 neigh, on systems that have it.
+func getIPv6Neighbors() (addrs []string) {
+	out, err := exec.Command("ip", "-6", "neigh", "show").Output()
+	if err != nil {
+		return
+	}
+	seen := map[string]bool{}
+	// fe80::1 dev eth0 lladdr 00:11:22:33:44:55 router REACHABLE
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "dev" {
+			continue
+		}
+		switch fields[len(fields)-1] {
+		case "REACHABLE", "STALE", "DELAY", "PROBE":
+		default:
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.IsMulticast() || ip.IsUnspecified() || ip.IsLoopback() {
+			continue
+		}
+		addr := ip.String()
+		if ip.IsLinkLocalUnicast() {
+			addr += "%" + numericZone(fields[2])
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// States of the neighbour table entries, see NL_NEIGHBOR_STATE.
+const (
+	nlnsProbe     = 2
+	nlnsReachable = 5
+)
+
+// getIPv6Neighbors returns the IPv6 addresses in the neighbour table, the
+// hosts this computer has recently talked to on the local links. Unlike
+// IPv4 networks, IPv6 networks are far too large to scan.
+func getIPv6Neighbors() (addrs []string) {
+	var table unsafe.Pointer
+	ret, _, _ := iphlpapi.NewProc("GetIpNetTable2").Call(syscall.AF_INET6, uintptr(unsafe.Pointer(&table)))
+	if ret != 0 {
+		return
+	}
+	defer iphlpapi.NewProc("FreeMibTable").Call(uintptr(table))
+	// MIB_IPNET_ROW2
+	type row struct {
+		Family                uint16
+		Port                  uint16
+		FlowInfo              uint32
+		Addr                  [16]byte
+		ScopeID               uint32
+		InterfaceIndex        uint32
+		InterfaceLuid         uint64
+		PhysicalAddress       [32]byte
+		PhysicalAddressLength uint32
+		State                 uint32
+		Flags                 uint8
+		ReachabilityTime      uint32
+	}
+	count := *(*uint32)(table)
+	seen := map[string]bool{}
+	for i := uintptr(0); i < uintptr(count); i++ {
+		// the rows follow the 8-byte aligned NumEntries
+		r := (*row)(unsafe.Pointer(uintptr(table) + 8 + i*unsafe.Sizeof(row{})))
+		if r.State < nlnsProbe || r.State > nlnsReachable {
+			continue
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, r.Addr[:])
+		if ip.IsMulticast() || ip.IsUnspecified() || ip.IsLoopback() {
+			continue
+		}
+		addr := ip.String()
+		if ip.IsLinkLocalUnicast() {
+			addr += "%" + strconv.Itoa(int(r.InterfaceIndex))
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The jobs of the operations, run by the GUI and the command line alike.
+
+// targetJob returns a job on a device, addressed by its serial so that jobs
+// on different devices can run side by side. A network device is connected
+// to first if needed. The job runs on the default device of adb if target is
+// empty and there is not exactly one device.
+func targetJob(name, target string) *job {
+	j := newJob(name, defaultSerial(target))
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		j.add(connectStep(target))
+	}
+	return j
+}
+
+func viewJob(target string) *job {
+	return targetJob("view", target).add(
+		adbStep("devices"),
+		deviceStep(scrcpyExe),
+	)
+}
+
+// flashJob flashes the image in dir, which deletes everything on the device,
+// and waits for the device to start again if it is connected by USB.
+func flashJob(target, dir string) *job {
+	return targetJob("flash", target).add(flashSteps(dir)...)
+}
+
+func flashSteps(dir string) []*step {
+	fastboot := imageTool(dir, "fastboot")
+	// the image is flashed once all partitions are
+	audit := imageAudit(dir, nil)
+	flash := func(partition, image string, args ...string) *step {
+		image = filepath.Join(dir, image)
+		audit.files = append(audit.files, image)
+		s := fastbootStep(fastboot, image, append(append([]string{"flash"}, args...), partition, image)...)
+		s.Timeout = 10 * time.Minute
+		s.Audit = audit
+		return s
+	}
+	reboot := deviceStep(adbExe(), "reboot", "bootloader")
+	reboot.Timeout = time.Minute
+	system := flash("system", "system.img", "-S", "500M")
+	system.Timeout = 30 * time.Minute
+	steps := []*step{
+		bootloaderSerialStep(),
+		reboot,
+		flash("devcfg", "devcfg.mbn"),
+		flash("devcfgbak", "devcfg.mbn"),
+		flash("dsp", "adspso.bin"),
+		flash("cache", "cache.img"),
+		flash("aboot", "emmc_appsboot.mbn"),
+		flash("boot", "boot.img"),
+		flash("persist", "persist.img"),
+		flash("recovery", "recovery.img"),
+		system,
+		flash("userdata", "userdata.img"),
+		fastbootDeviceStep(fastboot, "reboot"),
+	}
+	steps = append(steps, &step{
+		Run: func(ctx context.Context, j *job) error {
+			j.log(levelInfo, "", "flashed "+audit.Name, nil)
+			if isNetworkSerial(j.serial()) {
+				j.log(levelWarn, "", "not waiting for the device, which comes back with adb over the network turned off", nil)
+			}
+			return nil
+		},
+	})
+	for _, s := range waitSteps(nil) {
+		steps = append(steps, skipOnNetwork(s))
+	}
+	return steps
+}
+
+// skipOnNetwork makes a step do nothing on a network device, which can't be
+// reached over the network any more once it has been flashed.
+func skipOnNetwork(s *step) *step {
+	run := s.Run
+	s.Run = func(ctx context.Context, j *job) error {
+		if isNetworkSerial(j.serial()) {
+			return nil
+		}
+		return run(ctx, j)
+	}
+	return s
+}
+
+func isNetworkSerial(serial string) bool {
+	_, _, err := net.SplitHostPort(serial)
+	return err == nil
+}
+
+func installJob(target string, apks []string) *job {
+	return targetJob("install", target).add(installSteps(apks)...)
+}
+
+func installSteps(apks []string) (steps []*step) {
+	for _, path := range apks {
+		apk := strings.TrimSpace(path)
+		if apk == "" {
+			continue
+		}
+		install := adbStep("install", "-r", apk)
+		install.Timeout = 10 * time.Minute
+		install.Audit = apkAudit(apk)
+		if fi, err := os.Stat(apk); err == nil {
+			install.Size = fi.Size()
+		}
+		steps = append(steps,
+			messageStep("Installing", apk),
+			install,
+			recordInstall(apk),
+		)
+	}
+	return
+}
+
+// uninstallJob uninstalls a package, keeping its data and cache if keepData
+// is set.
+func uninstallJob(target, pkg string, keepData bool) *job {
+	j := targetJob("uninstall", target)
+	if pkg == "" {
+		return j
+	}
+	return j.add(uninstallSteps(pkg, keepData)...)
+}
+
+func uninstallSteps(pkg string, keepData bool) []*step {
+	uninstall := adbStep("uninstall", pkg)
+	if keepData {
+		// adb uninstall refuses -k and points to the package manager, which
+		// exits with 0 on older versions of Android even if it fails
+		args := []string{"shell", "cmd", "package", "uninstall", "-k", pkg}
+		uninstall = adbStep(args...)
+		uninstall.Run = func(ctx context.Context, j *job) error {
+			out, err := j.command(ctx, nil, libAdbExe, append(j.serialArgs(), args...)...)
+			if err != nil {
+				return err
+			}
+			if m := shellFailure.FindString(out); m != "" {
+				return errors.New(m)
+			}
+			return nil
+		}
+	}
+	uninstall.Timeout = 2 * time.Minute
+	uninstall.Audit = packageAudit(pkg)
+	return []*step{
+		messageStep("Uninstalling", pkg),
+		uninstall,
+		recordUninstall(pkg),
+	}
+}
+
+// packagesJob lists the third-party packages installed on the device.
+func packagesJob(target string, packages func([]string)) *job {
+	return targetJob("reload", target).add(&step{
+		Name:    "list packages",
+		Timeout: time.Minute,
+		Run: func(ctx context.Context, j *job) error {
+			name, args := toolCommand(libAdbExe, append(j.serialArgs(),
+				"shell", "cmd", "package", "list", "packages", "-3")...)
+			// the output is not logged, there may be hundreds of packages
+			cmd := exec.CommandContext(ctx, name, args...)
+			hideWindow(cmd)
+			out, err := cmd.Output()
+			if err != nil {
+				return err
+			}
+			packages(strings.Fields(regexp.MustCompile("(?m)^package:").ReplaceAllString(string(out), "")))
+			return nil
+		},
+	})
+}
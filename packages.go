@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// packageInfo is an app installed on a device, from the package manager.
+// The times are the local time of the device as it prints them.
+type packageInfo struct {
+	Name        string              `json:"name"`
+	VersionName string              `json:"version_name,omitempty"`
+	VersionCode string              `json:"version_code,omitempty"`
+	Installed   string              `json:"installed,omitempty"`
+	Updated     string              `json:"updated,omitempty"`
+	Size        int64               `json:"size"` // of the APK
+	Enabled     bool                `json:"enabled"`
+	System      bool                `json:"system"`
+	Installer   string              `json:"installer,omitempty"`
+	Path        string              `json:"path,omitempty"`
+	Permissions []packagePermission `json:"permissions,omitempty"`
+}
+
+// packagePermission is a runtime permission the app asks for.
+type packagePermission struct {
+	Name    string `json:"name"`
+	Granted bool   `json:"granted"`
+}
+
+// packageFilters are the sets of packages that can be listed, with the
+// options of pm list packages for them.
+var packageFilters = map[string][]string{
+	"third-party": {"-3"},
+	"system":      {"-s"},
+	"all":         {"-3", "-s"},
+}
+
+// the API level of Android 14, the first with pm clear --cache-only
+const clearCacheSDK = 34
+
+// packageActions are the commands of the package manager, run with adb
+// shell. Granting and revoking needs a permission.
+var packageActions = map[string]func(pkg, permission string) []string{
+	"launch": func(pkg, _ string) []string {
+		return []string{"monkey", "-p", pkg, "-c", "android.intent.category.LAUNCHER", "1"}
+	},
+	"force-stop": func(pkg, _ string) []string {
+		return []string{"am", "force-stop", pkg}
+	},
+	"clear-data": func(pkg, _ string) []string {
+		return []string{"pm", "clear", pkg}
+	},
+	// needs clearCacheSDK
+	"clear-cache": func(pkg, _ string) []string {
+		return []string{"pm", "clear", "--cache-only", pkg}
+	},
+	"disable": func(pkg, _ string) []string {
+		return []string{"pm", "disable-user", "--user", "0", pkg}
+	},
+	"enable": func(pkg, _ string) []string {
+		return []string{"pm", "enable", pkg}
+	},
+	"grant": func(pkg, permission string) []string {
+		return []string{"pm", "grant", pkg, permission}
+	},
+	"revoke": func(pkg, permission string) []string {
+		return []string{"pm", "revoke", pkg, permission}
+	},
+}
+
+// the actions that change the device for good, recorded in the audit log
+var auditedPackageActions = map[string]bool{
+	"clear-data": true,
+	"disable":    true,
+	"enable":     true,
+}
+
+var (
+	// the names of packages and permissions, which are passed to adb shell
+	// and must not have anything the shell would act on
+	packageName = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)+$`)
+
+	dumpsysPackage    = regexp.MustCompile(`^\s+Package \[([^\]]+)\]`)
+	dumpsysPermission = regexp.MustCompile(`^\s+([\w.]+): granted=(true|false)`)
+
+	// adb shell exits with 0 on older versions of Android whatever the
+	// command does, so its output is checked as well
+	shellFailure = regexp.MustCompile(`(?m)^(Failure.*|Error.*|Exception.*|.*monkey aborted.*|.*Unknown package.*)$`)
+)
+
+// shellOutput runs a command with adb shell on the device of the job
+// without logging its output, which may be long.
+func (j *job) shellOutput(ctx context.Context, args ...string) (string, error) {
+	out, err := toolOutput(ctx, libAdbExe, append(append(j.serialArgs(), "shell"), args...)...)
+	return strings.Replace(string(out), "\r", "", -1), err
+}
+
+// packageListJob lists the packages of filter installed on the device, with
+// their details.
+func packageListJob(target, filter string, packages func([]*packageInfo)) (*job, error) {
+	flags, ok := packageFilters[filter]
+	if !ok {
+		return nil, errors.New("unknown filter " + filter + ", use third-party, system or all")
+	}
+	return targetJob("reload", target).add(&step{
+		Name:    "list packages",
+		Timeout: 2 * time.Minute,
+		Run: func(ctx context.Context, j *job) error {
+			list, err := listPackages(ctx, j, flags)
+			if err != nil {
+				return err
+			}
+			packages(list)
+			return nil
+		},
+	}), nil
+}
+
+func listPackages(ctx context.Context, j *job, flags []string) ([]*packageInfo, error) {
+	byName := map[string]*packageInfo{}
+	for _, flag := range flags {
+		out, err := j.shellOutput(ctx, "pm", "list", "packages", "-f", "-i", flag)
+		if err != nil {
+			return nil, fmt.Errorf("pm list packages: %v: %s", err, strings.TrimSpace(out))
+		}
+		for _, p := range parsePackageList(out) {
+			p.System = flag == "-s"
+			byName[p.Name] = p
+		}
+	}
+	if out, err := j.shellOutput(ctx, "pm", "list", "packages", "-d"); err == nil {
+		for _, p := range parsePackageList(out) {
+			if known, ok := byName[p.Name]; ok {
+				known.Enabled = false
+			}
+		}
+	}
+	if out, err := j.shellOutput(ctx, "dumpsys", "package", "packages"); err == nil {
+		for name, details := range parseDumpsysPackages(out) {
+			if p, ok := byName[name]; ok {
+				p.VersionName, p.VersionCode = details.VersionName, details.VersionCode
+				p.Installed, p.Updated = details.Installed, details.Updated
+				p.Permissions = details.Permissions
+			}
+		}
+	}
+	var list []*packageInfo
+	var paths []string
+	byPath := map[string]*packageInfo{}
+	for _, p := range byName {
+		list = append(list, p)
+		if p.Path != "" {
+			paths = append(paths, p.Path)
+			byPath[p.Path] = p
+		}
+	}
+	// a few at a time to keep the command lines short
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > 40 {
+			n = 40
+		}
+		out, _ := j.shellOutput(ctx, append([]string{"stat", "-c", "'%s %n'"}, paths[:n]...)...)
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil && byPath[fields[1]] != nil {
+				byPath[fields[1]].Size = size
+			}
+		}
+		paths = paths[n:]
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].Name < list[b].Name
+	})
+	return list, ctx.Err()
+}
+
+// parsePackageList parses the lines of pm list packages -f -i, like
+// "package:/data/app/~~Yt8w==/com.example-Q2w==/base.apk=com.example
+// installer=com.android.vending". The path may have "=" in it but the name
+// of the package can't.
+func parsePackageList(out string) (packages []*packageInfo) {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "package:") {
+			continue
+		}
+		p := &packageInfo{Enabled: true}
+		line = strings.TrimPrefix(line, "package:")
+		if i := strings.Index(line, " installer="); i >= 0 {
+			p.Installer = strings.TrimSpace(line[i+len(" installer="):])
+			if p.Installer == "null" {
+				p.Installer = ""
+			}
+			line = strings.TrimSpace(line[:i])
+		}
+		p.Name = line
+		if i := strings.LastIndex(line, "="); i >= 0 {
+			p.Path, p.Name = line[:i], line[i+1:]
+		}
+		packages = append(packages, p)
+	}
+	return
+}
+
+// parseDumpsysPackages parses the versions, install times and runtime
+// permissions of the first user from dumpsys package packages. Only the
+// Packages section counts, the hidden system packages are the versions
+// that have been updated.
+func parseDumpsysPackages(out string) map[string]*packageInfo {
+	packages := map[string]*packageInfo{}
+	var p *packageInfo
+	inPackages := true
+	runtime, users := false, 0
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" && line[0] != ' ' {
+			inPackages = strings.HasPrefix(line, "Packages:")
+			p = nil
+			continue
+		}
+		if m := dumpsysPackage.FindStringSubmatch(line); m != nil {
+			p = nil
+			if inPackages && packages[m[1]] == nil {
+				p = &packageInfo{Name: m[1]}
+				packages[m[1]] = p
+			}
+			runtime, users = false, 0
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		value := func(prefix string) string {
+			return strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "versionCode="):
+			if fields := strings.Fields(value("versionCode=")); len(fields) > 0 {
+				p.VersionCode = fields[0]
+			}
+		case strings.HasPrefix(trimmed, "versionName="):
+			p.VersionName = value("versionName=")
+		case strings.HasPrefix(trimmed, "firstInstallTime="):
+			p.Installed = value("firstInstallTime=")
+		case strings.HasPrefix(trimmed, "lastUpdateTime="):
+			p.Updated = value("lastUpdateTime=")
+		case strings.HasPrefix(trimmed, "User "):
+			users++
+			runtime = false
+		case trimmed == "runtime permissions:":
+			runtime = users <= 1
+		default:
+			m := dumpsysPermission.FindStringSubmatch(line)
+			if runtime && m != nil {
+				p.Permissions = append(p.Permissions, packagePermission{Name: m[1], Granted: m[2] == "true"})
+			} else {
+				runtime = false
+			}
+		}
+	}
+	return packages
+}
+
+// checkPackageAction returns why an action can't be run on a package.
+func checkPackageAction(action, pkg, permission string) error {
+	if _, ok := packageActions[action]; !ok {
+		return errors.New("unknown action " + action)
+	}
+	if err := checkPackageName(pkg); err != nil {
+		return err
+	}
+	if action == "grant" || action == "revoke" {
+		if permission == "" {
+			return errors.New("permission is missing")
+		}
+		if !packageName.MatchString(permission) {
+			return errors.New("invalid permission " + permission)
+		}
+	}
+	return nil
+}
+
+// checkPackageName returns why pkg is not the name of a package.
+func checkPackageName(pkg string) error {
+	if pkg == "" {
+		return errors.New("package is missing")
+	}
+	if !packageName.MatchString(pkg) {
+		return errors.New("invalid package " + pkg)
+	}
+	return nil
+}
+
+// packageActionJob runs an action of packageActions on a package, which
+// checkPackageAction has let through.
+func packageActionJob(target, action, pkg, permission string) *job {
+	args := packageActions[action](pkg, permission)
+	s := &step{
+		Name:    action,
+		Timeout: time.Minute,
+		Run: func(ctx context.Context, j *job) error {
+			if action == "clear-cache" {
+				sdk, _ := strconv.Atoi(j.adbOutput(ctx, "shell", "getprop", "ro.build.version.sdk"))
+				if sdk < clearCacheSDK {
+					return errors.New("clearing only the cache needs Android 14 or later, clear the data instead")
+				}
+			}
+			out, err := j.command(ctx, nil, libAdbExe, append(append(j.serialArgs(), "shell"), args...)...)
+			if err != nil {
+				return err
+			}
+			if m := shellFailure.FindString(out); m != "" {
+				return errors.New(m)
+			}
+			return nil
+		},
+	}
+	if auditedPackageActions[action] {
+		s.Audit = packageAudit(pkg)
+	}
+	return targetJob(action, target).add(s)
+}
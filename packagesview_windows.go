@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+var (
+	packageFilterNames = []string{"Third-party", "System", "All"}
+	packageFilterKeys  = []string{"third-party", "system", "all"}
+)
+
+// packageRow is a row in the package manager.
+type packageRow struct {
+	Name      string
+	Version   string
+	Code      string
+	Installed string
+	Updated   string
+	Size      string
+	Enabled   string
+	Installer string
+
+	info *packageInfo
+}
+
+func newPackageRow(p *packageInfo) *packageRow {
+	row := &packageRow{
+		Name:      p.Name,
+		Version:   p.VersionName,
+		Code:      p.VersionCode,
+		Installed: p.Installed,
+		Updated:   p.Updated,
+		Enabled:   "yes",
+		Installer: p.Installer,
+		info:      p,
+	}
+	if p.Size > 0 {
+		row.Size = formatSize(p.Size)
+	}
+	if !p.Enabled {
+		row.Enabled = "no"
+	}
+	return row
+}
+
+// permissionRow is a runtime permission of the selected package.
+type permissionRow struct {
+	Name    string
+	Granted string
+}
+
+// showPackages shows the packages installed on the device in the address
+// box, with the actions of the package manager.
+func showPackages() {
+	text := adbAddress.Text()
+	if isTargetSet(text) {
+		walk.MsgBox(md, "Error", "Please select a single device instead of "+text, walk.MsgBoxOK|walk.MsgBoxIconError)
+		return
+	}
+	target := addressOf(text)
+	var dlg *walk.Dialog
+	var filter *walk.ComboBox
+	var search *walk.LineEdit
+	var table, permTable *walk.TableView
+	var reloadButton, enableButton, grantButton, revokeButton *walk.PushButton
+	// launch, force stop, clear cache, clear data, enable, uninstall and
+	// uninstall keeping the data
+	actionButtons := make([]*walk.PushButton, 7)
+	var all []*packageInfo
+	var rows []*packageRow
+	var perms []*permissionRow
+	created, closed := false, false
+	selected := func() *packageInfo {
+		i := table.CurrentIndex()
+		if i < 0 || i >= len(rows) {
+			return nil
+		}
+		return rows[i].info
+	}
+	selectedPermission := func() string {
+		i := permTable.CurrentIndex()
+		if i < 0 || i >= len(perms) {
+			return ""
+		}
+		return perms[i].Name
+	}
+	showPermission := func() {
+		name := selectedPermission()
+		granted := name != "" && perms[permTable.CurrentIndex()].Granted == "yes"
+		grantButton.SetEnabled(name != "" && !granted)
+		revokeButton.SetEnabled(name != "" && granted)
+	}
+	showSelected := func() {
+		p := selected()
+		for _, b := range actionButtons {
+			b.SetEnabled(p != nil)
+		}
+		perms = nil
+		if p != nil {
+			if p.Enabled {
+				enableButton.SetText("DISABLE")
+			} else {
+				enableButton.SetText("ENABLE")
+			}
+			for _, perm := range p.Permissions {
+				granted := "no"
+				if perm.Granted {
+					granted = "yes"
+				}
+				perms = append(perms, &permissionRow{Name: perm.Name, Granted: granted})
+			}
+		}
+		permTable.SetModel(perms)
+		showPermission()
+	}
+	showRows := func() {
+		name := ""
+		if p := selected(); p != nil {
+			name = p.Name
+		}
+		query := strings.ToLower(strings.TrimSpace(search.Text()))
+		rows = nil
+		index := -1
+		for _, p := range all {
+			if query != "" && !strings.Contains(strings.ToLower(p.Name), query) {
+				continue
+			}
+			if p.Name == name {
+				index = len(rows)
+			}
+			rows = append(rows, newPackageRow(p))
+		}
+		table.SetModel(rows)
+		table.SetCurrentIndex(index)
+		showSelected()
+	}
+	reload := func() {
+		key := packageFilterKeys[0]
+		if i := filter.CurrentIndex(); i >= 0 && i < len(packageFilterKeys) {
+			key = packageFilterKeys[i]
+		}
+		var list []*packageInfo
+		j, err := packageListJob(target, key, func(packages []*packageInfo) {
+			list = packages
+		})
+		if err != nil {
+			walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+			return
+		}
+		reloadButton.SetEnabled(false)
+		go func() {
+			ok := queue.wait(j)
+			md.Synchronize(func() {
+				if closed {
+					return
+				}
+				reloadButton.SetEnabled(true)
+				if ok {
+					all = list
+					showRows()
+				}
+			})
+		}()
+	}
+	run := func(action, permission, confirm string) {
+		p := selected()
+		if p == nil {
+			return
+		}
+		if err := checkPackageAction(action, p.Name, permission); err != nil {
+			walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+			return
+		}
+		if confirm != "" {
+			ret := walk.MsgBox(dlg, "Packages", fmt.Sprintf(confirm, p.Name),
+				walk.MsgBoxYesNo|walk.MsgBoxIconExclamation|walk.MsgBoxDefButton2)
+			if ret != walk.DlgCmdYes {
+				return
+			}
+		}
+		runJobs(func() {
+			if !closed {
+				reload()
+			}
+		}, packageActionJob(target, action, p.Name, permission))
+	}
+	uninstall := func(keepData bool) {
+		p := selected()
+		if p == nil {
+			return
+		}
+		confirm := "Are you sure you want to uninstall %s?"
+		if keepData {
+			confirm = "Are you sure you want to uninstall %s and keep its data?"
+		}
+		ret := walk.MsgBox(dlg, "Packages", fmt.Sprintf(confirm, p.Name),
+			walk.MsgBoxYesNo|walk.MsgBoxIconExclamation|walk.MsgBoxDefButton2)
+		if ret != walk.DlgCmdYes {
+			return
+		}
+		runJobs(func() {
+			if !closed {
+				reload()
+			}
+		}, uninstallJob(target, p.Name, keepData))
+	}
+	actionButton := func(i int, text string, clicked func()) PushButton {
+		return PushButton{
+			AssignTo:  &actionButtons[i],
+			Text:      text,
+			OnClicked: clicked,
+		}
+	}
+	Dialog{
+		AssignTo: &dlg,
+		Layout:   VBox{},
+		Title:    "Packages on " + target,
+		MinSize:  Size{860, 560},
+		Children: []Widget{
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					ComboBox{
+						AssignTo:     &filter,
+						Model:        packageFilterNames,
+						CurrentIndex: 0,
+						OnCurrentIndexChanged: func() {
+							if created {
+								reload()
+							}
+						},
+					},
+					LineEdit{
+						AssignTo:      &search,
+						CueBanner:     "Search",
+						OnTextChanged: func() { showRows() },
+					},
+					PushButton{
+						AssignTo:  &reloadButton,
+						Text:      "RELOAD",
+						OnClicked: func() { reload() },
+					},
+				},
+			},
+			TableView{
+				AssignTo: &table,
+				Columns: []TableViewColumn{
+					{Title: "Package", DataMember: "Name", Width: 210},
+					{Title: "Version", DataMember: "Version", Width: 100},
+					{Title: "Code", DataMember: "Code", Width: 60},
+					{Title: "Installed", DataMember: "Installed", Width: 120},
+					{Title: "Updated", DataMember: "Updated", Width: 120},
+					{Title: "Size", DataMember: "Size", Width: 70},
+					{Title: "Enabled", DataMember: "Enabled", Width: 55},
+					{Title: "Installer", DataMember: "Installer", Width: 130},
+				},
+				OnCurrentIndexChanged: func() { showSelected() },
+			},
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					actionButton(0, "LAUNCH", func() { run("launch", "", "") }),
+					actionButton(1, "FORCE STOP", func() { run("force-stop", "", "") }),
+					actionButton(2, "CLEAR CACHE", func() { run("clear-cache", "", "") }),
+					actionButton(3, "CLEAR DATA", func() {
+						run("clear-data", "", "Are you sure you want to delete all data of %s?")
+					}),
+					actionButton(4, "DISABLE", func() {
+						if p := selected(); p != nil && p.Enabled {
+							run("disable", "", "")
+						} else {
+							run("enable", "", "")
+						}
+					}),
+					actionButton(5, "UNINSTALL", func() { uninstall(false) }),
+					actionButton(6, "UNINSTALL, KEEP DATA", func() { uninstall(true) }),
+				},
+			},
+			TableView{
+				AssignTo: &permTable,
+				MinSize:  Size{Height: 120},
+				MaxSize:  Size{Height: 120},
+				Columns: []TableViewColumn{
+					{Title: "Runtime Permission", DataMember: "Name", Width: 420},
+					{Title: "Granted", DataMember: "Granted", Width: 60},
+				},
+				OnCurrentIndexChanged: func() { showPermission() },
+			},
+			Composite{
+				Layout: HBox{MarginsZero: true},
+				Children: []Widget{
+					PushButton{
+						AssignTo:  &grantButton,
+						Text:      "GRANT",
+						OnClicked: func() { run("grant", selectedPermission(), "") },
+					},
+					PushButton{
+						AssignTo:  &revokeButton,
+						Text:      "REVOKE",
+						OnClicked: func() { run("revoke", selectedPermission(), "") },
+					},
+					HSpacer{},
+				},
+			},
+		},
+	}.Create(md)
+	created = true
+	enableButton = actionButtons[4]
+	updateDialog(dlg)
+	showSelected()
+	reload()
+	dlg.Run()
+	closed = true
+}
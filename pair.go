@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Wireless debugging (Android 11+) requires pairing before connecting. The
+// pairing protocol (SPAKE2 over TLS) is not implemented here: it is left to
+// adb pair of platform-tools 30 or later, so that the device trusts the key
+// of the adb server that makes the connections later. The key stays in the
+// adbkey of adb, only the GUID and address of paired devices are kept.
+
+type pairedDevice struct {
+	// GUID is the mDNS instance name prefix of the device, like
+	// "adb-0A1B2C3D-xYz12a".
+	GUID    string    `json:"guid"`
+	Address string    `json:"address"`
+	Paired  time.Time `json:"paired"`
+}
+
+// the first version of platform-tools with adb pair
+const minPairingPlatformTools = 30
+
+var (
+	errPairingCode = errors.New("the pairing code must be 6 digits")
+
+	// Version 30.0.5-6877874
+	platformToolsVersion = regexp.MustCompile(`(?m)^Version (\d+)\.`)
+)
+
+// pairingQRCode returns the text for the QR code the device scans in
+// "Pair device with QR code", and the service name and password in it.
+func pairingQRCode() (text, name, password string) {
+	name = "adbinstall-" + randomString(6)
+	password = randomString(10)
+	text = fmt.Sprintf("WIFI:T:ADB;S:%s;P:%s;;", name, password)
+	return
+}
+
+func randomString(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		r, _ := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		b[i] = chars[r.Int64()]
+	}
+	return string(b)
+}
+
+// waitForPairingService waits until the device that scanned the QR code
+// advertises the pairing service named name, and returns its address.
+func waitForPairingService(ctx context.Context, name string) (string, error) {
+	for {
+		bctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		services, err := browseMDNS(bctx, mdnsADBPairing)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		for _, s := range services {
+			if s.Name() != name {
+				continue
+			}
+			if addrs := s.Addresses(); len(addrs) > 0 {
+				return addrs[0], nil
+			}
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+}
+
+// pair pairs with the device at addr using the pairing code or the
+// password of the QR code, connects to it and remembers it.
+func pair(ctx context.Context, addr, code string) (*pairedDevice, error) {
+	if err := checkAdbPair(ctx); err != nil {
+		return nil, err
+	}
+	log.Println("Pairing with", addr)
+	out, err := toolOutput(ctx, libAdbExe, "pair", addr, code)
+	text := strings.TrimSpace(string(out))
+	if text != "" {
+		log.Println(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Successfully paired to 192.168.1.5:37123 [guid=adb-0A1B2C3D-xYz12a]
+	m := regexp.MustCompile(`(?i)successfully paired.*\[guid=([^\]]+)\]`).FindStringSubmatch(text)
+	if m == nil {
+		return nil, fmt.Errorf("adb pair failed to pair with %s", addr)
+	}
+	device := &pairedDevice{
+		GUID:   m[1],
+		Paired: time.Now(),
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if connectAddr, err := findConnectService(ctx, device.GUID, host); err == nil {
+		device.Address = connectAddr
+		toolOutput(ctx, libAdbExe, "connect", connectAddr)
+		log.Println("Connected to", connectAddr)
+	} else {
+		log.Println("Paired, but the device can't be found to connect:", err)
+	}
+	err = updateConfig(func(c *config) {
+		for i, d := range c.PairedDevices {
+			if d.GUID == device.GUID {
+				c.PairedDevices = append(c.PairedDevices[:i], c.PairedDevices[i+1:]...)
+				break
+			}
+		}
+		c.PairedDevices = append(c.PairedDevices, device)
+	})
+	return device, err
+}
+
+// checkAdbPair returns why adb can't pair, which it does since
+// platform-tools 30.
+func checkAdbPair(ctx context.Context) error {
+	out, err := toolOutput(ctx, libAdbExe, "version")
+	if err != nil {
+		return fmt.Errorf("pairing needs adb of platform-tools %d or later: %v", minPairingPlatformTools, err)
+	}
+	m := platformToolsVersion.FindStringSubmatch(strings.Replace(string(out), "\r", "", -1))
+	if m == nil {
+		return fmt.Errorf("pairing needs adb of platform-tools %d or later, this adb does not tell its version", minPairingPlatformTools)
+	}
+	if v, _ := strconv.Atoi(m[1]); v < minPairingPlatformTools {
+		return fmt.Errorf("pairing needs adb of platform-tools %d or later, this one is %s", minPairingPlatformTools, m[1])
+	}
+	return nil
+}
+
+// findConnectService looks up the current address of the connect service
+// of a paired device, which changes whenever wireless debugging is turned
+// on. If guid is empty, the service on host is looked for instead.
+func findConnectService(ctx context.Context, guid, host string) (string, error) {
+	bctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	services, err := browseMDNS(bctx, mdnsADBConnect)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range services {
+		if guid != "" && !strings.HasPrefix(s.Name(), guid) {
+			continue
+		}
+		for _, ip := range s.IPs {
+			if guid == "" && !sameHost(ip, host) {
+				continue
+			}
+			return net.JoinHostPort(ip.String(), strconv.Itoa(int(s.Port))), nil
+		}
+	}
+	return "", fmt.Errorf("no wireless debugging service found for %s", guid+host)
+}
+
+// sameHost reports whether ip is the host of an address, ignoring the zone.
+func sameHost(ip net.IPAddr, host string) bool {
+	host, _ = splitZone(host)
+	return ip.IP.Equal(net.ParseIP(host))
+}
+
+// pairedAddress returns the current address of a paired device that was
+// last seen at addr, or addr itself if it is not a paired device or can't
+// be found.
+func pairedAddress(addr string) string {
+	c := loadConfig()
+	for _, d := range c.PairedDevices {
+		if d.Address != addr {
+			continue
+		}
+		if hasADB(addr) {
+			return addr
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		newAddr, err := findConnectService(ctx, d.GUID, "")
+		if err != nil || newAddr == addr {
+			return addr
+		}
+		log.Printf("%s is now at %s", d.GUID, newAddr)
+		guid := d.GUID
+		updateConfig(func(c *config) {
+			for _, d := range c.PairedDevices {
+				if d.GUID == guid {
+					d.Address = newAddr
+				}
+			}
+		})
+		return newAddr
+	}
+	return addr
+}
+
+func hasADB(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := probeADB(ctx, addr, loadADBKey())
+	return err == nil
+}
+
+func validPairingCode(code string) error {
+	if !regexp.MustCompile(`^\d{6}$`).MatchString(code) {
+		return errPairingCode
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+	"github.com/skip2/go-qrcode"
+)
+
+func showPairing() {
+	var dlg *walk.Dialog
+	var pairAddress, pairCode *walk.LineEdit
+	var pairButton *walk.PushButton
+	var qrStatus *walk.TextLabel
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	qrText, qrName, qrPassword := pairingQRCode()
+	var qrImage walk.Image
+	if qr, err := qrcode.New(qrText, qrcode.Medium); err == nil {
+		qrImage, _ = walk.NewBitmapFromImage(qr.Image(180))
+	}
+	addr := ""
+	if strings.HasSuffix(adbAddress.Text(), "[pairing]") {
+		addr = addressOf(adbAddress.Text())
+	}
+	paired := func(device *pairedDevice) {
+		if device.Address != "" {
+			adbAddress.SetText(device.Address)
+		}
+	}
+	Dialog{
+		AssignTo:  &dlg,
+		Layout:    VBox{},
+		Title:     "Pair Device",
+		MinSize:   Size{460, 380},
+		FixedSize: true,
+		Children: []Widget{
+			GroupBox{
+				Title:  "Pair device with pairing code",
+				Layout: Grid{Columns: 3},
+				Children: []Widget{
+					TextLabel{
+						Text:          "IP address and port:",
+						TextAlignment: AlignHNearVCenter,
+					},
+					LineEdit{
+						AssignTo:   &pairAddress,
+						Text:       addr,
+						ColumnSpan: 2,
+					},
+					TextLabel{
+						Text:          "Wi-Fi pairing code:",
+						TextAlignment: AlignHNearVCenter,
+					},
+					LineEdit{
+						AssignTo:  &pairCode,
+						MaxLength: 6,
+					},
+					PushButton{
+						AssignTo: &pairButton,
+						Text:     "PAIR",
+						OnClicked: func() {
+							addr := strings.TrimSpace(pairAddress.Text())
+							code := strings.TrimSpace(pairCode.Text())
+							if err := validPairingCode(code); err != nil {
+								walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+								return
+							}
+							pairButton.SetEnabled(false)
+							go func() {
+								defer pairButton.SetEnabled(true)
+								device, err := pair(ctx, addr, code)
+								if err != nil {
+									walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+									return
+								}
+								paired(device)
+								dlg.Accept()
+							}()
+						},
+					},
+				},
+			},
+			GroupBox{
+				Title:  "Pair device with QR code",
+				Layout: HBox{},
+				Children: []Widget{
+					ImageView{
+						Image:   qrImage,
+						Mode:    ImageViewModeIdeal,
+						MinSize: Size{180, 180},
+					},
+					TextLabel{
+						AssignTo: &qrStatus,
+						Text: "On the device, open Developer options > Wireless debugging > " +
+							"Pair device with QR code and scan this QR code.",
+					},
+				},
+			},
+		},
+	}.Create(md)
+	updateDialog(dlg)
+	go func() {
+		addr, err := waitForPairingService(ctx, qrName)
+		if err != nil {
+			return
+		}
+		qrStatus.SetText("Pairing with " + addr + "...")
+		device, err := pair(ctx, addr, qrPassword)
+		if err != nil {
+			if ctx.Err() == nil {
+				qrStatus.SetText("Failed to pair with " + addr + ": " + err.Error())
+			}
+			return
+		}
+		paired(device)
+		dlg.Accept()
+	}()
+	dlg.Run()
+}
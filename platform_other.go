@@ -0,0 +1,72 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const exeSuffix = ""
+
+// adb and scrcpy are installed separately, the bundled ones are for Windows
+var (
+	libAdbExe = "adb"
+	scrcpyExe = "scrcpy"
+)
+
+func defaultDataDir() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "adbinstall")
+}
+
+func toolCommand(exe string, args ...string) (string, []string) {
+	return exe, args
+}
+
+// hideWindow starts the command in a process group of its own, so that it
+// can be killed with its children.
+func hideWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessTree(pid int) {
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+func findADBProcess() (pid int) {
+	out, _ := exec.Command("pgrep", "-x", "adb").Output()
+	if fields := strings.Fields(string(out)); len(fields) > 0 {
+		pid, _ = strconv.Atoi(fields[0])
+	}
+	return
+}
+
+func attachConsole() {}
+
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// lockFile waits for an exclusive lock on f, which other processes respect
+// too.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const exeSuffix = ".exe"
+
+var (
+	libAdbExe = `lib\adb.exe`
+	scrcpyExe = `lib\scrcpy.exe`
+
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+	iphlpapi = syscall.NewLazyDLL("iphlpapi.dll")
+)
+
+func defaultDataDir() string {
+	return filepath.Join(os.Getenv("PROGRAMDATA"), "AndroidUpdater")
+}
+
+// toolCommand returns the command running a program like adb through cmd,
+// which finds the bundled programs relative to the working directory.
+func toolCommand(exe string, args ...string) (string, []string) {
+	return "cmd", append([]string{"/c", exe}, args...)
+}
+
+// hideWindow keeps a console program from flashing a window.
+func hideWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+}
+
+// killProcessTree kills a process and its children, killing cmd /c alone
+// would leave the command it runs behind.
+func killProcessTree(pid int) {
+	cmd := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid))
+	hideWindow(cmd)
+	cmd.Run()
+}
+
+func findADBProcess() (pid int) {
+	// github.com/mitchellh/go-ps
+	handle, _, _ := kernel32.NewProc("CreateToolhelp32Snapshot").Call(0x00000002, 0)
+	if handle < 0 {
+		return
+	}
+	defer kernel32.NewProc("CloseHandle").Call(handle)
+	var entry struct {
+		Size              uint32
+		CntUsage          uint32
+		ProcessID         uint32
+		DefaultHeapID     uintptr
+		ModuleID          uint32
+		CntThreads        uint32
+		ParentProcessID   uint32
+		PriorityClassBase int32
+		Flags             uint32
+		ExeFile           [260]uint16
+	}
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	ret, _, _ := kernel32.NewProc("Process32FirstW").Call(handle, uintptr(unsafe.Pointer(&entry)))
+	if ret == 0 {
+		return
+	}
+	for {
+		e := &entry
+		end := 0
+		for {
+			if e.ExeFile[end] == 0 {
+				break
+			}
+			end++
+		}
+		if syscall.UTF16ToString(e.ExeFile[:end]) == "adb.exe" {
+			pid = int(e.ProcessID)
+			return
+		}
+		ret, _, _ := kernel32.NewProc("Process32NextW").Call(handle, uintptr(unsafe.Pointer(&entry)))
+		if ret == 0 {
+			break
+		}
+	}
+	return
+}
+
+// attachConsole lets the output be seen in the console the program is
+// started from, as it is built as a GUI program that doesn't get one.
+func attachConsole() {
+	if _, err := os.Stdout.Stat(); err == nil {
+		return // redirected
+	}
+	const attachParentProcess = ^uintptr(0)
+	if ret, _, _ := kernel32.NewProc("AttachConsole").Call(attachParentProcess); ret == 0 {
+		return
+	}
+	if f, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+		os.Stdout, os.Stderr = f, f
+	}
+}
+
+func freeSpace(dir string) (int64, error) {
+	var free uint64
+	ret, _, err := kernel32.NewProc("GetDiskFreeSpaceExW").Call(
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(dir))),
+		uintptr(unsafe.Pointer(&free)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
+
+// lockFile waits for an exclusive lock on f, which other processes respect
+// too.
+func lockFile(f *os.File) error {
+	const lockfileExclusiveLock = 2
+	var overlapped syscall.Overlapped
+	ret, _, err := kernel32.NewProc("LockFileEx").Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) {
+	var overlapped syscall.Overlapped
+	kernel32.NewProc("UnlockFileEx").Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+}
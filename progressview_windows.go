@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+var (
+	stateColors = map[string]color.RGBA{
+		"pending":   {0xbd, 0xbd, 0xbd, 0xff},
+		"running":   {0x21, 0x96, 0xf3, 0xff},
+		"done":      {0x4c, 0xaf, 0x50, 0xff},
+		"failed":    {0xf4, 0x43, 0x36, 0xff},
+		"cancelled": {0xff, 0x98, 0x00, 0xff},
+		"skipped":   {0xe0, 0xe0, 0xe0, 0xff},
+	}
+	stateIcons = map[string]walk.Image{}
+)
+
+// progressRow is a step in the progress view.
+type progressRow struct {
+	Step    string
+	Device  string
+	Status  string
+	Elapsed string
+	Sent    string
+
+	state string
+}
+
+// stateIcon returns a dot in the color of the state of a step.
+func stateIcon(state string) walk.Image {
+	if icon, ok := stateIcons[state]; ok {
+		return icon
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	c := stateColors[state]
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			dx, dy := float64(x)-7.5, float64(y)-7.5
+			if dx*dx+dy*dy <= 30 {
+				img.Set(x, y, c)
+			}
+		}
+	}
+	icon, err := walk.NewBitmapFromImage(img)
+	if err != nil {
+		return nil
+	}
+	stateIcons[state] = icon
+	return icon
+}
+
+func formatElapsed(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// showProgress shows the progress of every step of the jobs until they are
+// finished and the window is closed.
+func showProgress(title string, jobs []*job) {
+	var dlg *walk.Dialog
+	var table *walk.TableView
+	var summary *walk.TextLabel
+	var stopBtn, closeBtn *walk.PushButton
+	var rows []*progressRow
+	refresh := func() {
+		var all []stepStatus
+		rows = nil
+		running := false
+		failed := ""
+		for _, j := range jobs {
+			for _, s := range j.progress() {
+				all = append(all, s)
+				switch s.State {
+				case "pending", "running":
+					running = true
+				case "failed", "cancelled":
+					if failed == "" {
+						failed = s.Name
+					}
+				}
+				if s.Name == "" {
+					continue
+				}
+				row := &progressRow{
+					Step:   s.Name,
+					Device: j.Device,
+					Status: s.State,
+					state:  s.State,
+				}
+				if !s.Started.IsZero() {
+					row.Elapsed = formatElapsed(s.Elapsed())
+				}
+				if s.Size > 0 {
+					row.Sent = formatSize(s.Sent) + " / " + formatSize(s.Size)
+				}
+				rows = append(rows, row)
+			}
+		}
+		done := 0
+		var elapsed time.Duration
+		var first time.Time
+		for _, s := range all {
+			if s.State == "done" {
+				done++
+			}
+			if !s.Started.IsZero() && (first.IsZero() || s.Started.Before(first)) {
+				first = s.Started
+			}
+		}
+		if !first.IsZero() {
+			elapsed = time.Since(first)
+		}
+		text := fmt.Sprintf("%d of %d steps done, %s elapsed", done, len(all), formatElapsed(elapsed))
+		if left, ok := eta(all); ok && running {
+			text += fmt.Sprintf(", about %s left", formatElapsed(left))
+		}
+		if !running {
+			if failed != "" {
+				text = "Stopped at " + failed + " after " + formatElapsed(elapsed)
+			} else {
+				text = "Finished in " + formatElapsed(elapsed)
+			}
+		}
+		index := table.CurrentIndex()
+		table.SetModel(rows)
+		table.SetCurrentIndex(index)
+		summary.SetText(text)
+		stopBtn.SetEnabled(running)
+		closeBtn.SetEnabled(!running)
+	}
+	Dialog{
+		AssignTo: &dlg,
+		Layout:   VBox{},
+		Title:    title,
+		MinSize:  Size{520, 400},
+		Children: []Widget{
+			TableView{
+				AssignTo: &table,
+				Columns: []TableViewColumn{
+					{Title: "Step", DataMember: "Step", Width: 170},
+					{Title: "Device", DataMember: "Device", Width: 120},
+					{Title: "Status", DataMember: "Status", Width: 70},
+					{Title: "Elapsed", DataMember: "Elapsed", Width: 55},
+					{Title: "Sent", DataMember: "Sent", Width: 110},
+				},
+				StyleCell: func(style *walk.CellStyle) {
+					if style.Col() == 0 && style.Row() < len(rows) {
+						style.Image = stateIcon(rows[style.Row()].state)
+					}
+				},
+			},
+			TextLabel{
+				AssignTo: &summary,
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						StretchFactor: 3,
+					},
+					PushButton{
+						AssignTo: &stopBtn,
+						Text:     "STOP",
+						OnClicked: func() {
+							queue.cancel(jobs...)
+						},
+					},
+					PushButton{
+						AssignTo: &closeBtn,
+						Text:     "CLOSE",
+						OnClicked: func() {
+							dlg.Accept()
+						},
+					},
+				},
+			},
+		},
+	}.Create(md)
+	updateDialog(dlg)
+	for _, j := range jobs {
+		j.subscribe(func(*job) {
+			dlg.Synchronize(refresh)
+		})
+	}
+	// elapsed time and ETA change by the second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	closed := make(chan bool)
+	defer close(closed)
+	go func() {
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+				dlg.Synchronize(refresh)
+			}
+		}
+	}()
+	refresh()
+	dlg.Closing().Attach(func(canceled *bool, reason walk.CloseReason) {
+		if !closeBtn.Enabled() {
+			*canceled = true // still running, STOP first
+		}
+	})
+	dlg.Run()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// queuedJob is a job waiting in the queue of its device.
+type queuedJob struct {
+	job  *job
+	done chan error
+}
+
+// jobQueue runs the jobs of a device one after another, in the order they
+// are added, while jobs of different devices run side by side. It is the
+// only place jobs are run from, so they never race on the connection of a
+// device, and its listeners are told whenever a job starts or finishes.
+type jobQueue struct {
+	mutex     sync.Mutex
+	pending   map[string][]*queuedJob
+	running   map[string]*job
+	history   []*job
+	listeners []func()
+}
+
+// the jobs that are kept to look up by ID
+const maxJobHistory = 200
+
+var queue = &jobQueue{
+	pending: map[string][]*queuedJob{},
+	running: map[string]*job{},
+}
+
+// add queues a job on its device. The returned channel receives the error
+// of the job once it is finished, or cancelled before it started.
+func (q *jobQueue) add(j *job) <-chan error {
+	qj := &queuedJob{job: j, done: make(chan error, 1)}
+	q.mutex.Lock()
+	_, working := q.pending[j.Device]
+	q.pending[j.Device] = append(q.pending[j.Device], qj)
+	if len(q.history) >= maxJobHistory {
+		q.history = append([]*job{}, q.history[maxJobHistory/10:]...)
+	}
+	q.history = append(q.history, j)
+	q.mutex.Unlock()
+	if !working {
+		go q.work(j.Device)
+	}
+	q.notify()
+	return qj.done
+}
+
+// work runs the jobs of a device until there are no more.
+func (q *jobQueue) work(device string) {
+	for {
+		q.mutex.Lock()
+		list := q.pending[device]
+		if len(list) == 0 {
+			delete(q.pending, device)
+			delete(q.running, device)
+			q.mutex.Unlock()
+			q.notify()
+			return
+		}
+		qj := list[0]
+		q.pending[device] = list[1:]
+		q.running[device] = qj.job
+		q.mutex.Unlock()
+		q.notify()
+		if existingAdbPid == -1 {
+			existingAdbPid = findADBProcess()
+		}
+		err := qj.job.run(context.Background())
+		observeJob(qj.job)
+		auditJob(qj.job)
+		qj.done <- err
+	}
+}
+
+// cancel stops the jobs, whether they are running or still queued.
+func (q *jobQueue) cancel(jobs ...*job) {
+	stop := map[*job]bool{}
+	for _, j := range jobs {
+		stop[j] = true
+	}
+	var removed []*queuedJob
+	q.mutex.Lock()
+	for device, list := range q.pending {
+		var keep []*queuedJob
+		for _, qj := range list {
+			if stop[qj.job] {
+				removed = append(removed, qj)
+			} else {
+				keep = append(keep, qj)
+			}
+		}
+		q.pending[device] = keep
+	}
+	q.mutex.Unlock()
+	for _, qj := range removed {
+		qj.job.stop()
+		qj.job.skip()
+		observeJob(qj.job)
+		qj.done <- &stepError{Err: context.Canceled}
+	}
+	for _, j := range jobs {
+		j.stop()
+	}
+	q.notify()
+}
+
+// cancelAll stops every job.
+func (q *jobQueue) cancelAll() {
+	q.cancel(q.jobs()...)
+}
+
+// jobs returns the running jobs and the queued ones after them.
+func (q *jobQueue) jobs() (jobs []*job) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, j := range q.running {
+		jobs = append(jobs, j)
+	}
+	for _, list := range q.pending {
+		for _, qj := range list {
+			jobs = append(jobs, qj.job)
+		}
+	}
+	return
+}
+
+// recent returns the jobs added lately, the oldest first.
+func (q *jobQueue) recent() []*job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]*job{}, q.history...)
+}
+
+// find returns the recent job with the ID.
+func (q *jobQueue) find(id string) *job {
+	for _, j := range q.recent() {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// counts returns how many jobs are running and how many are waiting.
+func (q *jobQueue) counts() (running, queued int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, list := range q.pending {
+		queued += len(list)
+	}
+	return len(q.running), queued
+}
+
+// subscribe calls f whenever a job is added, starts or finishes.
+func (q *jobQueue) subscribe(f func()) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.listeners = append(q.listeners, f)
+}
+
+func (q *jobQueue) notify() {
+	q.mutex.Lock()
+	listeners := append([]func(){}, q.listeners...)
+	q.mutex.Unlock()
+	for _, f := range listeners {
+		f()
+	}
+}
+
+// wait queues the jobs and returns whether all of them succeeded once they
+// are finished.
+func (q *jobQueue) wait(jobs ...*job) bool {
+	var results []<-chan error
+	for _, j := range jobs {
+		results = append(results, q.add(j))
+	}
+	ok := true
+	for _, r := range results {
+		if err := <-r; err != nil {
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A recipe is a provisioning workflow in a YAML or JSON file, like
+//
+//	name: Store unit
+//	vars:
+//	  config: store.json
+//	steps:
+//	  - flash: images/v12
+//	  - uninstall: {package: com.example.old, keep_data: true}
+//	  - install: [launcher.apk, pos.apk]
+//	  - push: {from: "${config}", to: /sdcard/config.json}
+//	  - shell: am broadcast -a com.example.CONFIGURE
+//	  - settings: {namespace: global, key: stay_on_while_plugged_in, value: 3}
+//	  - assert-prop: {name: ro.product.model, value: "${model}"}
+//	  - reboot
+//	  - sleep: 30s
+//
+// Every step is an action with its value, a list of values or named fields,
+// and may have a timeout, for all the steps of an action like flash
+// together, and a number of retries. flash and reboot wait for the device to
+// boot, wait-for-device and wait-for-boot wait for a device started
+// otherwise. ${name} is replaced by a variable of the recipe, one
+// given to run it, or serial, device, model, site or nickname of the device,
+// while $name is left to the shell. Relative paths are relative to the file.
+type recipe struct {
+	Name  string
+	Dir   string
+	Vars  map[string]string
+	Steps []recipeStep
+}
+
+type recipeStep struct {
+	Action  string
+	Values  []string
+	Fields  map[string]string
+	Timeout time.Duration
+	Retries int
+}
+
+// recipeVariable is a variable in the values of a step.
+var recipeVariable = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// recipeArgs are the values of a step with the variables replaced.
+type recipeArgs struct {
+	Values []string
+	Fields map[string]string
+	dir    string
+}
+
+// arg returns the named field, or the value at i if the step is given a
+// value or a list.
+func (a recipeArgs) arg(i int, field string) string {
+	if v, ok := a.Fields[field]; ok {
+		return v
+	}
+	if i < len(a.Values) {
+		return a.Values[i]
+	}
+	return ""
+}
+
+func (a recipeArgs) require(i int, field string) (string, error) {
+	if v := a.arg(i, field); v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("%s is missing", field)
+}
+
+func (a recipeArgs) path(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(a.dir, p)
+}
+
+// recipeActions build the steps of the actions of recipes.
+var recipeActions = map[string]func(a recipeArgs) ([]*step, error){
+	"flash": func(a recipeArgs) ([]*step, error) {
+		dir := a.path(a.arg(0, "image"))
+		if dir == "" {
+			dir = currentImageDir()
+		}
+		return flashSteps(dir), nil
+	},
+	"wait-for-device": func(a recipeArgs) ([]*step, error) {
+		return waitSteps(nil)[:1], nil
+	},
+	"wait-for-boot": func(a recipeArgs) ([]*step, error) {
+		return waitSteps(nil), nil
+	},
+	"install": func(a recipeArgs) ([]*step, error) {
+		apks := a.Values
+		if apk, ok := a.Fields["apk"]; ok {
+			apks = []string{apk}
+		}
+		if len(apks) == 0 {
+			return nil, errors.New("apk is missing")
+		}
+		for i := range apks {
+			apks[i] = a.path(apks[i])
+		}
+		return installSteps(apks), nil
+	},
+	"uninstall": func(a recipeArgs) ([]*step, error) {
+		pkg, err := a.require(0, "package")
+		if err != nil {
+			return nil, err
+		}
+		return uninstallSteps(pkg, a.Fields["keep_data"] == "true"), nil
+	},
+	"push": func(a recipeArgs) ([]*step, error) {
+		from, err := a.require(0, "from")
+		if err != nil {
+			return nil, err
+		}
+		to, err := a.require(1, "to")
+		if err != nil {
+			return nil, err
+		}
+		from = a.path(from)
+		s := adbStep("push", from, to)
+		s.Name = "push " + filepath.Base(from)
+		s.Timeout = 10 * time.Minute
+		if fi, err := os.Stat(from); err == nil {
+			s.Size = fi.Size()
+		}
+		return []*step{s}, nil
+	},
+	"shell": func(a recipeArgs) ([]*step, error) {
+		command := strings.Join(a.Values, " ")
+		if c, ok := a.Fields["command"]; ok {
+			command = c
+		}
+		if command == "" {
+			return nil, errors.New("command is missing")
+		}
+		s := adbStep("shell", command)
+		s.Name = "shell " + strings.Fields(command)[0]
+		s.Timeout = 5 * time.Minute
+		return []*step{s}, nil
+	},
+	"settings": func(a recipeArgs) ([]*step, error) {
+		if len(a.Values) == 1 {
+			a.Values = strings.Fields(a.Values[0])
+		}
+		namespace := a.arg(0, "namespace")
+		if namespace == "" {
+			namespace = "global"
+		}
+		key, err := a.require(1, "key")
+		if err != nil {
+			return nil, err
+		}
+		value := a.arg(2, "value")
+		s := adbStep("shell", "settings", "put", namespace, key, value)
+		s.Name = "settings put " + key
+		s.Timeout = time.Minute
+		return []*step{s}, nil
+	},
+	"reboot": func(a recipeArgs) ([]*step, error) {
+		mode := a.arg(0, "mode")
+		if mode == "" {
+			return rebootSteps(), nil
+		}
+		s := adbStep("reboot", mode)
+		s.Timeout = time.Minute
+		return []*step{s}, nil
+	},
+	"sleep": func(a recipeArgs) ([]*step, error) {
+		d, err := time.ParseDuration(a.arg(0, "duration"))
+		if err != nil {
+			return nil, err
+		}
+		return []*step{{
+			Name: "sleep " + d.String(),
+			Run: func(ctx context.Context, j *job) error {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(d):
+					return nil
+				}
+			},
+		}}, nil
+	},
+	"assert-prop": func(a recipeArgs) ([]*step, error) {
+		if len(a.Values) == 1 && strings.Contains(a.Values[0], "=") {
+			a.Values = strings.SplitN(a.Values[0], "=", 2)
+		}
+		name, err := a.require(0, "name")
+		if err != nil {
+			return nil, err
+		}
+		want := a.arg(1, "value")
+		return []*step{{
+			Name:    "assert " + name,
+			Timeout: time.Minute,
+			Run: func(ctx context.Context, j *job) error {
+				out, err := j.command(ctx, nil, libAdbExe, append(j.serialArgs(), "shell", "getprop", name)...)
+				if err != nil {
+					return err
+				}
+				if got := strings.TrimSpace(out); got != want {
+					return fmt.Errorf("%s is %q, not %q", name, got, want)
+				}
+				return nil
+			},
+		}}, nil
+	},
+}
+
+// loadRecipe reads a recipe. Its steps are checked once they are built for
+// a device, when the variables are known.
+func loadRecipe(path string) (*recipe, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &v)
+	} else {
+		err = yaml.Unmarshal(data, &v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	r, err := parseRecipe(plainValue(v))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	r.Dir = filepath.Dir(path)
+	if r.Name == "" {
+		r.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return r, nil
+}
+
+// plainValue turns the maps of YAML into the maps of JSON.
+func plainValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprint(k)] = plainValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = plainValue(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = plainValue(e)
+		}
+		return v
+	}
+	return v
+}
+
+func parseRecipe(v interface{}) (*recipe, error) {
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("not a recipe")
+	}
+	r := &recipe{Vars: map[string]string{}}
+	if name, ok := root["name"]; ok {
+		r.Name = fmt.Sprint(name)
+	}
+	if vars, ok := root["vars"].(map[string]interface{}); ok {
+		for k, v := range vars {
+			r.Vars[k] = scalarString(v)
+		}
+	}
+	steps, ok := root["steps"].([]interface{})
+	if !ok || len(steps) == 0 {
+		return nil, errors.New("no steps")
+	}
+	for i, v := range steps {
+		s, err := parseRecipeStep(v)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		r.Steps = append(r.Steps, s)
+	}
+	return r, nil
+}
+
+func parseRecipeStep(v interface{}) (s recipeStep, err error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		// an action without a value, like "- reboot"
+		m = map[string]interface{}{scalarString(v): nil}
+	}
+	for k, value := range m {
+		switch k {
+		case "timeout":
+			if s.Timeout, err = time.ParseDuration(scalarString(value)); err != nil {
+				return
+			}
+			continue
+		case "retries":
+			if s.Retries, err = strconv.Atoi(scalarString(value)); err != nil {
+				return
+			}
+			continue
+		}
+		if _, ok := recipeActions[k]; !ok {
+			return s, fmt.Errorf("unknown action %q", k)
+		}
+		if s.Action != "" {
+			return s, fmt.Errorf("both %s and %s", s.Action, k)
+		}
+		s.Action = k
+		switch value := value.(type) {
+		case nil:
+		case []interface{}:
+			for _, e := range value {
+				s.Values = append(s.Values, scalarString(e))
+			}
+		case map[string]interface{}:
+			s.Fields = map[string]string{}
+			for f, e := range value {
+				s.Fields[f] = scalarString(e)
+			}
+		default:
+			s.Values = []string{scalarString(value)}
+		}
+	}
+	if s.Action == "" {
+		return s, errors.New("no action")
+	}
+	return
+}
+
+func scalarString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func (s recipeStep) build(r *recipe, expand func(string) string) ([]*step, error) {
+	a := recipeArgs{dir: r.Dir, Fields: map[string]string{}}
+	for _, v := range s.Values {
+		a.Values = append(a.Values, expand(v))
+	}
+	for k, v := range s.Fields {
+		a.Fields[k] = expand(v)
+	}
+	steps, err := recipeActions[s.Action](a)
+	if err != nil {
+		return nil, err
+	}
+	var named []*step
+	for _, st := range steps {
+		if st.Name != "" {
+			named = append(named, st)
+		}
+	}
+	if s.Timeout > 0 && len(named) == 1 {
+		named[0].Timeout = s.Timeout
+	} else if s.Timeout > 0 {
+		// an action like flash keeps the timeouts of its steps, which have
+		// the timeout of the recipe step to finish in together
+		var deadline time.Time
+		for _, st := range named {
+			run := st.Run
+			st.Run = func(ctx context.Context, j *job) error {
+				if deadline.IsZero() {
+					deadline = time.Now().Add(s.Timeout)
+				}
+				dctx, cancel := context.WithDeadline(ctx, deadline)
+				defer cancel()
+				err := run(dctx, j)
+				if err != nil && ctx.Err() == nil && dctx.Err() == context.DeadlineExceeded {
+					return fmt.Errorf("%s timed out after %s: %w", s.Action, s.Timeout, context.DeadlineExceeded)
+				}
+				return err
+			}
+		}
+	}
+	for _, st := range named {
+		if s.Retries > 0 {
+			st.Retries = s.Retries
+			st.RetryDelay = 5 * time.Second
+		}
+	}
+	return steps, nil
+}
+
+// flashes returns whether the recipe deletes everything on the device.
+func (r *recipe) flashes() bool {
+	for _, s := range r.Steps {
+		if s.Action == "flash" {
+			return true
+		}
+	}
+	return false
+}
+
+// recipeJob returns the job running the recipe on a device, with vars
+// taking the place of the variables of the recipe.
+func recipeJob(r *recipe, target string, vars map[string]string) (*job, error) {
+	j := targetJob(r.Name, target)
+	values := map[string]string{}
+	for k, v := range r.Vars {
+		values[k] = v
+	}
+	for k, v := range vars {
+		values[k] = v
+	}
+	values["serial"] = j.Device
+	values["device"] = target
+	if d := loadInventory().find(j.Device); d != nil {
+		values["serial"] = d.Serial
+		values["model"] = d.Model
+		values["site"] = d.Site
+		values["nickname"] = d.Nickname
+	}
+	missing := map[string]bool{}
+	expand := func(s string) string {
+		return recipeVariable.ReplaceAllStringFunc(s, func(m string) string {
+			name := recipeVariable.FindStringSubmatch(m)[1]
+			v, ok := values[name]
+			if !ok {
+				missing[name] = true
+			}
+			return v
+		})
+	}
+	for i, s := range r.Steps {
+		steps, err := s.build(r, expand)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i+1, s.Action, err)
+		}
+		j.add(steps...)
+	}
+	if len(missing) > 0 {
+		var names []string
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown variables: %s", strings.Join(names, ", "))
+	}
+	return j, nil
+}
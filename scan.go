@@ -1,42 +1,129 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"log"
+	"math/big"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultADBPort = 5555
+
+	// networks larger than this are narrowed down to the hosts around the
+	// local address to keep a scan from taking forever
+	maxScanPrefix = 20
+)
+
 var (
 	mutex = &sync.Mutex{}
 )
 
-func getLocalADBAddresses() (out []string) {
-	addresses := getLocalAddresses()
-	for _, ip := range addresses {
-		a, b, c := (*ip)[0], (*ip)[1], (*ip)[2]
-		var wg sync.WaitGroup
-		for i := 2; i < 256; i++ {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				addr := net.IPv4(a, b, c, byte(i))
-				target := addr.String() + ":5555"
-				if !hasPort(target) {
-					return
-				}
-				log.Println("found", target)
-				mutex.Lock()
-				out = append(out, target)
-				mutex.Unlock()
-			}(i)
+// scanDevices finds devices on the networks of the scan options and by
+// mDNS, each address once.
+func scanDevices(ctx context.Context, c *config, progress func(done, total int)) (devices []*adbDevice) {
+	start := time.Now()
+	var discovered []*adbDevice
+	mdone := make(chan bool)
+	go func() {
+		discovered = discoverMDNSDevices(ctx)
+		close(mdone)
+	}()
+	ports, err := parsePorts(c.ScanPorts)
+	if err != nil {
+		log.Println(err)
+	}
+	scanned := getLocalADBAddresses(ctx, c.ScanTargets, ports, c.ScanConcurrency, progress)
+	<-mdone
+	seen := map[string]bool{}
+	for _, d := range append(scanned, discovered...) {
+		if !seen[d.Address] {
+			seen[d.Address] = true
+			devices = append(devices, d)
+			scanResults.inc(d.State)
 		}
-		wg.Wait()
 	}
+	scansTotal.inc()
+	scanDuration.observe(time.Since(start).Seconds())
+	return
+}
+
+// getLocalADBAddresses scans ports of targets (see parseTargets) for ADB
+// devices, or of the networks of the local interfaces and the IPv6
+// neighbours if targets is empty. At most concurrency addresses are probed
+// at the same time and progress is called after each probe.
+func getLocalADBAddresses(ctx context.Context, targets []string, ports []int, concurrency int, progress func(done, total int)) (out []*adbDevice) {
+	if len(targets) == 0 {
+		targets = append(getLocalNetworks(), getIPv6Neighbors()...)
+	}
+	hosts, err := parseTargets(ctx, targets)
+	if err != nil {
+		log.Println(err)
+	}
+	if len(ports) == 0 {
+		ports = []int{defaultADBPort}
+	}
+	var addrs []string
+	for _, ip := range hosts {
+		for _, port := range ports {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		}
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var done int32
+	key := loadADBKey()
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, target := range addrs {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				if progress != nil {
+					progress(int(atomic.AddInt32(&done, 1)), len(addrs))
+				}
+			}()
+			device, err := probeADB(ctx, target, key)
+			if err != nil {
+				if err == errNotADB {
+					log.Println(target, "is open but is not an ADB device")
+				}
+				return
+			}
+			log.Println("found", device)
+			mutex.Lock()
+			out = append(out, device)
+			mutex.Unlock()
+		}(target)
+	}
+	wg.Wait()
+	sort.Slice(out, func(i, j int) bool {
+		return compareAddresses(out[i].Address, out[j].Address) < 0
+	})
 	return
 }
 
-func getLocalAddresses() (addresses []*net.IP) {
+// getLocalNetworks returns the IPv4 networks of the local interfaces using
+// their real netmasks. IPv6 hosts are found with getIPv6Neighbors instead.
+func getLocalNetworks() (networks []string) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return
@@ -53,31 +140,209 @@ func getLocalAddresses() (addresses []*net.IP) {
 			continue
 		}
 		for _, addr := range addrs {
-			var ip net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
-			}
-			if ip == nil || ip.IsLoopback() {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() {
 				continue
 			}
-			ip = ip.To4()
+			ip := ipnet.IP.To4()
 			if ip == nil {
 				continue // not an ipv4 address
 			}
-			addresses = append(addresses, &ip)
+			ones, bits := ipnet.Mask.Size()
+			if bits != 32 {
+				continue
+			}
+			if ones < maxScanPrefix {
+				log.Printf("network %s/%d is too large, scanning %s/%d only", ip.Mask(ipnet.Mask), ones, ip.Mask(net.CIDRMask(maxScanPrefix, 32)), maxScanPrefix)
+				ones = maxScanPrefix
+			}
+			networks = append(networks, fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(ones, 32)), ones))
 		}
 	}
 	return
 }
 
-func hasPort(target string) bool {
-	conn, err := net.DialTimeout("tcp", target, 500*time.Millisecond)
+// parseTargets expands a list of targets to host addresses. Each target can
+// be a CIDR range (192.168.0.0/22 or fd00::/120), an IP range
+// (192.168.1.10-192.168.1.50 or 192.168.1.10-50), an IP address
+// (192.168.1.5, 2001:db8::5 or fe80::5%12) or a host name. Targets may also
+// be separated by commas or spaces.
+func parseTargets(ctx context.Context, targets []string) (hosts []net.IPAddr, err error) {
+	seen := map[string]bool{}
+	add := func(ip net.IPAddr) {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			hosts = append(hosts, ip)
+		}
+	}
+	var invalid []string
+	for _, t := range targets {
+		for _, target := range strings.FieldsFunc(t, isListSeparator) {
+			ips, err := expandTarget(ctx, target)
+			if err != nil {
+				invalid = append(invalid, target)
+				continue
+			}
+			for _, ip := range ips {
+				add(ip)
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		err = fmt.Errorf("invalid scan targets: %s", strings.Join(invalid, ", "))
+	}
+	return
+}
+
+// parsePorts parses a list of ports and port ranges like "5555, 5556-5585".
+func parsePorts(text string) (ports []int, err error) {
+	seen := map[int]bool{}
+	for _, field := range strings.FieldsFunc(text, isListSeparator) {
+		from, to := field, field
+		if i := strings.Index(field, "-"); i > 0 {
+			from, to = field[:i], field[i+1:]
+		}
+		first, err1 := strconv.Atoi(from)
+		last, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+			return nil, fmt.Errorf("invalid port: %s", field)
+		}
+		for port := first; port <= last; port++ {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	if len(ports) == 0 {
+		ports = []int{defaultADBPort}
+	}
+	return
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+}
+
+func expandTarget(ctx context.Context, target string) ([]net.IPAddr, error) {
+	target, zone := splitZone(target)
+	zone = numericZone(zone)
+	if strings.Contains(target, "/") {
+		_, ipnet, err := net.ParseCIDR(target)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones > 16 {
+			return nil, fmt.Errorf("range too large: %s", target)
+		}
+		first := ipnet.IP
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^ipnet.Mask[i]
+		}
+		if bits == 32 && ones <= 30 {
+			// skip network and broadcast addresses
+			first, last = nextIP(first), prevIP(last)
+		} else if bits == 128 && ones <= 126 {
+			// skip the subnet-router anycast address
+			first = nextIP(first)
+		}
+		return ipRange(first, last, zone), nil
+	}
+	if i := strings.Index(target, "-"); i > 0 && net.ParseIP(target[:i]) != nil {
+		from := net.ParseIP(target[:i])
+		to := net.ParseIP(target[i+1:])
+		if v4 := from.To4(); v4 != nil && to == nil {
+			// 192.168.1.10-50
+			to = net.ParseIP(fmt.Sprintf("%d.%d.%d.%s", v4[0], v4[1], v4[2], target[i+1:]))
+		}
+		if to == nil || (from.To4() == nil) != (to.To4() == nil) || bytes.Compare(from, to) > 0 {
+			return nil, fmt.Errorf("invalid range: %s", target)
+		}
+		if from.To4() != nil {
+			from, to = from.To4(), to.To4()
+		}
+		size := new(big.Int).Sub(new(big.Int).SetBytes(to), new(big.Int).SetBytes(from))
+		if size.Cmp(big.NewInt(1<<16)) >= 0 {
+			return nil, fmt.Errorf("range too large: %s", target)
+		}
+		return ipRange(from, to, zone), nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		return []net.IPAddr{{IP: ip, Zone: zone}}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target)
 	if err != nil {
-		return false
+		return nil, err
+	}
+	for i := range addrs {
+		addrs[i].Zone = numericZone(addrs[i].Zone)
+	}
+	return addrs, nil
+}
+
+// splitZone removes the zone from an IPv6 target like fe80::5%12 or
+// fe80::%eth0/120 and returns it separately.
+func splitZone(target string) (string, string) {
+	zone := ""
+	for {
+		i := strings.Index(target, "%")
+		if i < 0 {
+			return target, zone
+		}
+		j := strings.IndexAny(target[i:], "/-")
+		if j < 0 {
+			j = len(target) - i
+		}
+		zone = target[i+1 : i+j]
+		target = target[:i] + target[i+j:]
+	}
+}
+
+func ipRange(first, last net.IP, zone string) (ips []net.IPAddr) {
+	for ip := first; bytes.Compare(ip, last) <= 0; ip = nextIP(ip) {
+		ips = append(ips, net.IPAddr{IP: ip, Zone: zone})
+		if ip.Equal(last) {
+			break
+		}
+	}
+	return
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := append(net.IP{}, ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		if prev[i]--; prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// compareAddresses orders host:port addresses numerically by IP, IPv4
+// addresses first.
+func compareAddresses(a, b string) int {
+	hostA, _, _ := net.SplitHostPort(a)
+	hostB, _, _ := net.SplitHostPort(b)
+	hostA, _ = splitZone(hostA)
+	hostB, _ = splitZone(hostB)
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	if ipA == nil || ipB == nil {
+		return strings.Compare(a, b)
+	}
+	if c := bytes.Compare(ipA.To16(), ipB.To16()); c != 0 {
+		return c
 	}
-	conn.Close()
-	return true
+	return strings.Compare(a, b)
 }
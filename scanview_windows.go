@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+)
+
+func scan() {
+	if cancelScan != nil {
+		cancelScan()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelScan = cancel
+	c := loadConfig()
+	scanButton.SetText("<a>Stop</a>")
+	go func() {
+		defer func() {
+			cancel()
+			// cancelScan belongs to the GUI thread, which the Stop link runs on
+			md.Synchronize(func() {
+				cancelScan = nil
+				scanButton.SetText("<a>Scan</a>")
+			})
+		}()
+		var percent int32 = -1
+		devices := scanDevices(ctx, c, func(done, total int) {
+			p := int32(done * 100 / total)
+			if atomic.SwapInt32(&percent, p) != p {
+				scanButton.SetText(fmt.Sprintf("<a>Stop</a> %d%%", p))
+			}
+		})
+		if ctx.Err() != nil {
+			log.Println("scan cancelled")
+		}
+		var model []string
+		for _, d := range devices {
+			model = append(model, d.String())
+		}
+		adbAddress.SetModel(model)
+	}()
+}
+
+func showScanOptions() {
+	var dlg *walk.Dialog
+	var targets *walk.TextEdit
+	var ports *walk.LineEdit
+	var concurrency *walk.NumberEdit
+	c := loadConfig()
+	Dialog{
+		AssignTo:  &dlg,
+		Layout:    VBox{},
+		Title:     "Scan Options",
+		MinSize:   Size{400, 290},
+		FixedSize: true,
+		Children: []Widget{
+			TextLabel{
+				Text: "Networks and hosts to scan, one per line, e.g. 192.168.0.0/22, " +
+					"10.1.2.10-10.1.2.50, fd00::/120 or device.local. Leave empty to scan the networks and IPv6 neighbours of this computer.",
+			},
+			TextEdit{
+				AssignTo: &targets,
+				Text:     strings.Join(c.ScanTargets, "\r\n"),
+				VScroll:  true,
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "Ports:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					LineEdit{
+						AssignTo:      &ports,
+						StretchFactor: 3,
+						Text:          c.ScanPorts,
+						ToolTipText:   "A port, a list or a range of ports, e.g. 5555, 5556-5585",
+					},
+				},
+			},
+			HSplitter{
+				Children: []Widget{
+					TextLabel{
+						Text:          "Concurrent probes:",
+						StretchFactor: 1,
+						TextAlignment: AlignHNearVCenter,
+					},
+					NumberEdit{
+						AssignTo:      &concurrency,
+						StretchFactor: 1,
+						Value:         float64(c.ScanConcurrency),
+						MinValue:      1,
+						MaxValue:      1024,
+					},
+					TextLabel{
+						StretchFactor: 1,
+					},
+					PushButton{
+						Text:          "SAVE",
+						StretchFactor: 1,
+						OnClicked: func() {
+							var list []string
+							for _, line := range strings.Split(targets.Text(), "\n") {
+								if line = strings.TrimSpace(line); line != "" {
+									list = append(list, line)
+								}
+							}
+							if _, err := parseTargets(context.Background(), list); err != nil {
+								walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+								return
+							}
+							if _, err := parsePorts(ports.Text()); err != nil {
+								walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+								return
+							}
+							err := updateConfig(func(c *config) {
+								c.ScanTargets = list
+								c.ScanPorts = strings.TrimSpace(ports.Text())
+								c.ScanConcurrency = int(concurrency.Value())
+							})
+							if err != nil {
+								walk.MsgBox(dlg, "Error", err.Error(), walk.MsgBoxOK|walk.MsgBoxIconError)
+								return
+							}
+							dlg.Accept()
+						},
+					},
+				},
+			},
+		},
+	}.Create(md)
+	updateDialog(dlg)
+	dlg.Run()
+}
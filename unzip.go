@@ -9,7 +9,7 @@ import (
 	"time"
 )
 
-func unzipFile(ctx context.Context, zipfile string) error {
+func unzipFile(ctx context.Context, zipfile, dest string) error {
 	r, err := zip.OpenReader(zipfile)
 	if err != nil {
 		return err
@@ -22,33 +22,48 @@ func unzipFile(ctx context.Context, zipfile string) error {
 		}
 		total += f.UncompressedSize64
 	}
+	if err := checkFreeSpace(zipNeededSpace(r.File, dest)); err != nil {
+		return err
+	}
+	if total == 0 {
+		total = 1
+	}
 	var done uint64
 	for _, f := range r.File {
 		progChan := make(chan int64)
-		go func() {
-			var add uint64
+		go func(done uint64, name string) {
 			for c := range progChan {
-				add = uint64(c)
-				progressBar.SetValue(int((done + add) * 10000 / total))
-				downloadStatus.SetText("Extracting " + f.Name)
+				imageProgress(int((done+uint64(c))*10000/total), "Extracting "+name)
 			}
-			done += add
-		}()
-		if err := unzip(ctx, f, progChan); err != nil {
+		}(done, f.Name)
+		if err := unzip(ctx, f, dest, progChan); err != nil {
 			return err
 		}
+		if !f.FileInfo().IsDir() {
+			done += f.UncompressedSize64
+		}
 	}
 	return nil
 }
 
-func unzip(ctx context.Context, f *zip.File, progChan chan int64) error {
+func unzip(ctx context.Context, f *zip.File, dest string, progChan chan int64) error {
 	defer close(progChan)
 	rc, err := f.Open()
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
-	file, err := os.OpenFile(filepath.Join(imageDir, f.Name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	path, err := extractPath(dest, f.Name)
+	if err != nil {
+		return err
+	}
+	if f.FileInfo().IsDir() {
+		return os.MkdirAll(path, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
 	if err != nil {
 		return err
 	}
@@ -86,3 +101,20 @@ func unzip(ctx context.Context, f *zip.File, progChan chan int64) error {
 		}
 	}
 }
+
+// zipNeededSpace returns the extra space needed to extract files, taking
+// into account the files that will be overwritten.
+func zipNeededSpace(files []*zip.File, dest string) (need int64) {
+	for _, f := range files {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		need += int64(f.UncompressedSize64)
+		if path, err := extractPath(dest, f.Name); err == nil {
+			if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+				need -= fi.Size()
+			}
+		}
+	}
+	return
+}
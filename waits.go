@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	pollInterval = 2 * time.Second
+
+	// changes whenever the device boots
+	bootIDFile = "/proc/sys/kernel/random/boot_id"
+)
+
+// adbOutput runs adb on the device of the job without logging it, as it is
+// run over and over while waiting, and returns its trimmed output.
+func (j *job) adbOutput(ctx context.Context, args ...string) string {
+	out, _ := toolOutput(ctx, libAdbExe, append(j.serialArgs(), args...)...)
+	return strings.TrimSpace(strings.Replace(string(out), "\r", "", -1))
+}
+
+// poll calls ready until it returns true or ctx is done.
+func poll(ctx context.Context, ready func() bool) error {
+	for {
+		if ready() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// waitSteps returns the steps waiting for a device that is starting to be
+// usable: visible to adb, booted and with the package manager running. If
+// bootID is not empty, the device must have booted since it was read.
+func waitSteps(bootID *string) []*step {
+	return []*step{
+		{
+			Name:    "wait for device",
+			Timeout: 5 * time.Minute,
+			Run:     waitForDevice,
+		},
+		{
+			Name:    "wait for boot",
+			Timeout: 5 * time.Minute,
+			Run: func(ctx context.Context, j *job) error {
+				return poll(ctx, func() bool {
+					if bootID != nil && *bootID != "" && j.adbOutput(ctx, "shell", "cat", bootIDFile) == *bootID {
+						return false // not rebooted yet
+					}
+					return j.adbOutput(ctx, "shell", "getprop", "sys.boot_completed") == "1"
+				})
+			},
+		},
+		{
+			Name:    "wait for package manager",
+			Timeout: 2 * time.Minute,
+			Run: func(ctx context.Context, j *job) error {
+				return poll(ctx, func() bool {
+					return strings.HasPrefix(j.adbOutput(ctx, "shell", "pm", "path", "android"), "package:")
+				})
+			},
+		},
+	}
+}
+
+// waitForDevice waits for the device to be online, connecting to a network
+// device again whenever it is not.
+func waitForDevice(ctx context.Context, j *job) error {
+	reported := ""
+	return poll(ctx, func() bool {
+		state := j.adbOutput(ctx, "get-state")
+		if state == "device" {
+			return true
+		}
+		if state != reported && (state == "unauthorized" || state == "recovery" || state == "bootloader") {
+			j.log(levelWarn, "wait for device", "device is "+state, nil)
+			reported = state
+		}
+		serial := j.serial()
+		if _, _, err := net.SplitHostPort(serial); err != nil {
+			return false
+		}
+		if state == "offline" {
+			toolOutput(ctx, libAdbExe, "disconnect", serial)
+		}
+		// wireless debugging may be on another port after a reboot
+		addr := pairedAddress(serial)
+		out, _ := toolOutput(ctx, libAdbExe, "connect", addr)
+		if strings.Contains(string(out), "connected to") && addr != serial {
+			j.log(levelInfo, "wait for device", "reconnected at "+addr, nil)
+			j.mutex.Lock()
+			j.Serial = addr
+			j.mutex.Unlock()
+		}
+		return false
+	})
+}
+
+// rebootSteps returns the steps rebooting the device and waiting for it to
+// be usable again.
+func rebootSteps() []*step {
+	var bootID string
+	reboot := adbStep("reboot")
+	reboot.Timeout = time.Minute
+	run := reboot.Run
+	reboot.Run = func(ctx context.Context, j *job) error {
+		bootID = j.adbOutput(ctx, "shell", "cat", bootIDFile)
+		return run(ctx, j)
+	}
+	return append([]*step{reboot}, waitSteps(&bootID)...)
+}
@@ -0,0 +1,501 @@
+"use strict";
+
+// The token comes with the address printed by the daemon, and is kept so
+// that the page can be reloaded without it.
+let token = localStorage.getItem("token") || "";
+const hash = new URLSearchParams(location.hash.slice(1));
+if (hash.get("token")) {
+  token = hash.get("token");
+  localStorage.setItem("token", token);
+  history.replaceState(null, "", location.pathname);
+}
+if (!token) {
+  token = prompt("Token (in the token file of the daemon):") || "";
+  localStorage.setItem("token", token);
+}
+
+// The operator is who the audit log says ran the jobs of this browser.
+let operator = localStorage.getItem("operator");
+if (operator === null) {
+  operator = (prompt("Operator (for the audit log):") || "").trim();
+  localStorage.setItem("operator", operator);
+}
+
+const $ = (id) => document.getElementById(id);
+const levels = { debug: 0, info: 1, warn: 2, error: 3 };
+const maxEvents = 5000;
+let events = [];
+let scanned = [];
+let packages = [];
+let selectedPackage = null;
+
+async function api(method, path, body) {
+  const options = { method, headers: { Authorization: "Bearer " + token } };
+  if (operator) {
+    options.headers["X-Operator"] = operator;
+  }
+  if (body instanceof FormData) {
+    options.body = body;
+  } else if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, options);
+  const data = await resp.json().catch(() => ({}));
+  if (!resp.ok) {
+    if (resp.status === 401) {
+      localStorage.removeItem("token");
+    }
+    throw new Error(data.error || resp.statusText);
+  }
+  return data;
+}
+
+function showError(err) {
+  alert("Error: " + err.message);
+}
+
+function device() {
+  return $("address").value.trim();
+}
+
+function isTargetSet(text) {
+  return /^(tag|site):/.test(text);
+}
+
+function formatSize(b) {
+  const units = "KMGTPE";
+  if (b < 1024) {
+    return b + " B";
+  }
+  let exp = -1;
+  while (b >= 1024 && exp < units.length - 1) {
+    b /= 1024;
+    exp++;
+  }
+  return b.toFixed(2) + " " + units[exp] + "B";
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text || "";
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+// waitForJobs calls then once the jobs are finished, if all of them
+// succeeded.
+function waitForJobs(jobs, then) {
+  const timer = setInterval(async () => {
+    try {
+      const states = await Promise.all(jobs.map((j) => api("GET", "/api/jobs/" + j.id)));
+      if (states.some((j) => j.state === "queued" || j.state === "running")) {
+        return;
+      }
+      clearInterval(timer);
+      if (states.every((j) => j.state === "done")) {
+        then();
+      }
+    } catch (err) {
+      clearInterval(timer);
+    }
+  }, 1000);
+}
+
+async function refreshDevices() {
+  const devices = await api("GET", "/api/devices");
+  const tbody = $("devices");
+  tbody.textContent = "";
+  const options = new Set();
+  for (const d of devices) {
+    const row = tbody.insertRow();
+    cell(row, d.nickname ? d.serial + " (" + d.nickname + ")" : d.serial);
+    cell(row, d.state);
+    cell(row, d.model);
+    cell(row, d.product);
+    row.ondblclick = () => {
+      $("address").value = d.serial;
+    };
+    options.add(d.serial);
+    for (const tag of d.tags || []) {
+      options.add("tag:" + tag);
+    }
+    if (d.site) {
+      options.add("site:" + d.site);
+    }
+  }
+  for (const d of scanned) {
+    options.add(d.address);
+  }
+  const list = $("addresses");
+  list.textContent = "";
+  for (const value of options) {
+    const option = document.createElement("option");
+    option.value = value;
+    list.appendChild(option);
+  }
+}
+
+async function refreshJobs() {
+  const jobs = (await api("GET", "/api/jobs")).reverse().slice(0, 20);
+  const tbody = $("jobs");
+  tbody.textContent = "";
+  let running = 0;
+  let queued = 0;
+  for (const j of jobs) {
+    if (j.state === "running") {
+      running++;
+    } else if (j.state === "queued") {
+      queued++;
+    }
+    const step = j.steps.find((s) => s.state === "running" || s.state === "failed" || s.state === "cancelled") ||
+      j.steps[j.steps.length - 1] || { name: "" };
+    const row = tbody.insertRow();
+    cell(row, j.operation);
+    cell(row, j.device);
+    cell(row, step.name);
+    cell(row, j.state, "state " + j.state).title = j.error || "";
+    const size = j.steps.reduce((n, s) => n + s.size, 0);
+    const sent = j.steps.reduce((n, s) => n + s.sent, 0);
+    cell(row, size > 0 ? formatSize(sent) + " / " + formatSize(size) : "");
+    const actions = cell(row, "");
+    if (j.state === "queued" || j.state === "running") {
+      const cancel = document.createElement("a");
+      cancel.href = "#";
+      cancel.textContent = "Cancel";
+      cancel.onclick = (e) => {
+        e.preventDefault();
+        api("POST", "/api/jobs/" + j.id + "/cancel").catch(showError);
+      };
+      actions.appendChild(cancel);
+    }
+  }
+  $("stop").disabled = running + queued === 0;
+  $("queue").textContent = running > 0 ? running + " running" + (queued > 0 ? ", " + queued + " queued" : "") : "";
+}
+
+async function loadImages() {
+  const images = await api("GET", "/api/images");
+  const tbody = $("image-list");
+  tbody.textContent = "";
+  for (const image of images) {
+    const row = tbody.insertRow();
+    cell(row, image.id + (image.current ? " (current)" : ""));
+    cell(row, image.source);
+    cell(row, new Date(image.last_used).toLocaleString());
+    const actions = cell(row, "");
+    if (!image.current) {
+      const use = document.createElement("a");
+      use.href = "#";
+      use.textContent = "Use";
+      use.onclick = (e) => {
+        e.preventDefault();
+        api("POST", "/api/images/" + encodeURIComponent(image.id) + "/use").then(loadImages, showError);
+      };
+      actions.appendChild(use);
+    }
+  }
+}
+
+// reload lists the packages of the device with their details.
+async function reload() {
+  if (isTargetSet(device())) {
+    return;
+  }
+  const filter = $("package-filter").value;
+  packages = await api("GET", "/api/packages?details=1&filter=" + filter + "&device=" + encodeURIComponent(device()));
+  $("package-manager").hidden = false;
+  renderPackages();
+}
+
+function renderPackages() {
+  const query = $("package-search").value.trim().toLowerCase();
+  if (selectedPackage) {
+    selectedPackage = packages.find((p) => p.name === selectedPackage.name) || null;
+  }
+  const tbody = $("packages");
+  tbody.textContent = "";
+  for (const p of packages) {
+    if (query && !p.name.toLowerCase().includes(query)) {
+      continue;
+    }
+    const row = tbody.insertRow();
+    cell(row, p.name);
+    cell(row, p.version_code ? (p.version_name || "") + " (" + p.version_code + ")" : p.version_name);
+    cell(row, p.installed);
+    cell(row, p.updated);
+    cell(row, p.size > 0 ? formatSize(p.size) : "");
+    cell(row, p.enabled ? "yes" : "no");
+    cell(row, p.installer);
+    if (selectedPackage && p.name === selectedPackage.name) {
+      row.className = "selected";
+    }
+    row.onclick = () => {
+      selectedPackage = p;
+      renderPackages();
+    };
+  }
+  renderSelectedPackage();
+}
+
+function renderSelectedPackage() {
+  const p = selectedPackage;
+  for (const button of $("package-actions").querySelectorAll("button")) {
+    button.disabled = !p;
+  }
+  $("enable").textContent = p && !p.enabled ? "ENABLE" : "DISABLE";
+  const tbody = $("permissions");
+  tbody.textContent = "";
+  for (const perm of (p && p.permissions) || []) {
+    const row = tbody.insertRow();
+    cell(row, perm.name);
+    cell(row, perm.granted ? "yes" : "no");
+    const link = document.createElement("a");
+    link.href = "#";
+    link.textContent = perm.granted ? "Revoke" : "Grant";
+    link.onclick = (e) => {
+      e.preventDefault();
+      packageAction(perm.granted ? "revoke" : "grant", perm.name).catch(showError);
+    };
+    cell(row, "").appendChild(link);
+  }
+}
+
+// packageAction runs an action on the selected package and lists the
+// packages again once it is done.
+async function packageAction(action, permission) {
+  const jobs = await api("POST", "/api/packages/" + action, {
+    device: device(),
+    package: selectedPackage.name,
+    permission: permission || "",
+  });
+  if (!isTargetSet(device())) {
+    waitForJobs(jobs, () => reload().catch(showError));
+  }
+}
+
+async function uninstall(keepData) {
+  const question = keepData ? " and keep its data?" : "?";
+  if (!confirm("Are you sure you want to uninstall " + selectedPackage.name + question)) {
+    return;
+  }
+  const jobs = await api("POST", "/api/uninstall", {
+    device: device(),
+    package: selectedPackage.name,
+    keep_data: keepData,
+  });
+  if (!isTargetSet(device())) {
+    waitForJobs(jobs, () => reload().catch(showError));
+  }
+}
+
+function showOperator() {
+  $("operator").textContent = "Operator: " + (operator || "(daemon user)");
+}
+
+$("operator").onclick = (e) => {
+  e.preventDefault();
+  const name = prompt("Operator (for the audit log):", operator);
+  if (name !== null) {
+    operator = name.trim();
+    localStorage.setItem("operator", operator);
+    showOperator();
+  }
+};
+
+$("audit").onclick = async (e) => {
+  e.preventDefault();
+  try {
+    const resp = await fetch("/api/audit?format=csv", { headers: { Authorization: "Bearer " + token } });
+    if (!resp.ok) {
+      throw new Error((await resp.json().catch(() => ({}))).error || resp.statusText);
+    }
+    if (resp.headers.get("X-Audit-Verified") !== "true") {
+      alert("Warning: " + resp.headers.get("X-Audit-Error"));
+    }
+    const link = document.createElement("a");
+    link.href = URL.createObjectURL(await resp.blob());
+    link.download = "adbinstall-audit.csv";
+    link.click();
+    URL.revokeObjectURL(link.href);
+  } catch (err) {
+    showError(err);
+  }
+};
+
+$("scan").onclick = async (e) => {
+  e.preventDefault();
+  const link = $("scan");
+  if (link.textContent !== "Scan") {
+    return;
+  }
+  link.textContent = "Scanning...";
+  try {
+    scanned = await api("POST", "/api/scan");
+    await refreshDevices();
+  } catch (err) {
+    showError(err);
+  } finally {
+    link.textContent = "Scan";
+  }
+};
+
+$("view").onclick = () => {
+  api("POST", "/api/view", { device: device() }).catch(showError);
+};
+
+$("image").onclick = () => {
+  const section = $("images");
+  section.hidden = !section.hidden;
+  if (!section.hidden) {
+    loadImages().catch(showError);
+  }
+};
+
+$("download").onclick = async () => {
+  try {
+    const jobs = await api("POST", "/api/images", { source: $("source").value });
+    waitForJobs(jobs, () => loadImages().catch(showError));
+  } catch (err) {
+    showError(err);
+  }
+};
+
+$("flash").onclick = () => {
+  if (!confirm("Are you sure you want to flash image to the Android device? This will delete everything on the device!")) {
+    return;
+  }
+  api("POST", "/api/flash", { device: device() }).catch(showError);
+};
+
+$("stop").onclick = () => {
+  api("POST", "/api/stop").catch(showError);
+};
+
+$("apks").onchange = () => {
+  $("install").disabled = $("apks").files.length === 0;
+};
+
+$("install").onclick = async () => {
+  const form = new FormData();
+  form.append("device", device());
+  for (const file of $("apks").files) {
+    form.append("apk", file);
+  }
+  try {
+    const jobs = await api("POST", "/api/install", form);
+    if (!isTargetSet(device())) {
+      waitForJobs(jobs, () => reload().catch(showError));
+    }
+  } catch (err) {
+    showError(err);
+  }
+};
+
+$("reload").onclick = () => {
+  reload().catch(showError);
+};
+
+$("package-filter").onchange = () => {
+  reload().catch(showError);
+};
+
+$("package-search").oninput = renderPackages;
+
+for (const button of $("package-actions").querySelectorAll("button[data-action]")) {
+  button.onclick = () => {
+    const action = button.dataset.action;
+    if (action === "clear-data" && !confirm("Are you sure you want to delete all data of " + selectedPackage.name + "?")) {
+      return;
+    }
+    packageAction(action).catch(showError);
+  };
+}
+
+$("enable").onclick = () => {
+  packageAction(selectedPackage.enabled ? "disable" : "enable").catch(showError);
+};
+
+$("uninstall").onclick = () => {
+  uninstall(false).catch(showError);
+};
+
+$("uninstall-keep").onclick = () => {
+  uninstall(true).catch(showError);
+};
+
+function formatEvent(e) {
+  let s = new Date(e.time).toLocaleTimeString();
+  if (e.device) {
+    s += " [" + e.device + "]";
+  }
+  if (e.step) {
+    s += " " + e.step + ":";
+  }
+  return s + " " + e.message;
+}
+
+function matches(e) {
+  const text = $("text-filter").value.toLowerCase();
+  const deviceFilter = $("device-filter").value;
+  return levels[e.level] >= levels[$("level").value] &&
+    (deviceFilter === "" || e.device === deviceFilter) &&
+    (text === "" || formatEvent(e).toLowerCase().includes(text));
+}
+
+function renderConsole() {
+  const console = $("console");
+  console.textContent = events.filter(matches).map(formatEvent).join("\n") + "\n";
+  console.scrollTop = console.scrollHeight;
+}
+
+function addDeviceFilter(name) {
+  const select = $("device-filter");
+  if (!name || [...select.options].some((o) => o.value === name)) {
+    return;
+  }
+  const option = document.createElement("option");
+  option.value = option.textContent = name;
+  select.appendChild(option);
+}
+
+function followEvents() {
+  const source = new EventSource("/api/events?level=debug&history=1&token=" + encodeURIComponent(token));
+  let first = true;
+  source.onopen = () => {
+    if (first) {
+      first = false;
+    } else {
+      events = []; // the history is sent again
+    }
+  };
+  source.onmessage = (msg) => {
+    const e = JSON.parse(msg.data);
+    events.push(e);
+    if (events.length > maxEvents) {
+      events = events.slice(maxEvents / 10);
+    }
+    addDeviceFilter(e.device);
+    if (matches(e)) {
+      const console = $("console");
+      const bottom = console.scrollTop + console.clientHeight >= console.scrollHeight - 4;
+      console.textContent += formatEvent(e) + "\n";
+      if (bottom) {
+        console.scrollTop = console.scrollHeight;
+      }
+    }
+  };
+}
+
+for (const id of ["level", "device-filter", "text-filter"]) {
+  $(id).addEventListener("input", renderConsole);
+}
+
+showOperator();
+followEvents();
+refreshDevices().catch(showError);
+refreshJobs().catch(showError);
+setInterval(() => refreshDevices().catch(() => {}), 2000);
+setInterval(() => refreshJobs().catch(() => {}), 1000);